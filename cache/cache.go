@@ -0,0 +1,635 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kohlbau.de/x/jaye/flight"
+)
+
+const (
+	manifestName = "manifest.json"
+	partSuffix   = ".part"
+	// brokenName is the name a manifest which can not be decoded is moved to.
+	brokenName = manifestName + ".broken"
+	// touchInterval is the minimum time between two recorded accesses of an
+	// artifact, which spares writing the manifest on every request.
+	touchInterval = time.Minute
+)
+
+// Roles of artifacts, which are set when they are created.
+const (
+	// Intermediate artifacts are downloaded streams which are merged or
+	// converted into the files served to clients.
+	Intermediate = "intermediate"
+	Video        = "video"
+	Audio        = "audio"
+	Chapter      = "chapter"
+	Subtitles    = "subtitles"
+	Metadata     = "metadata"
+)
+
+// ErrBusy is returned for removals of artifacts of an id while artifacts of
+// the id are being written.
+var ErrBusy = errors.New("artifacts are being written")
+
+// Artifact describes a single file stored for an id.
+type Artifact struct {
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Complete bool      `json:"complete"`
+	Created  time.Time `json:"created"`
+	Accessed time.Time `json:"accessed,omitempty"`
+	// Role is empty for artifacts written before roles existed.
+	Role string `json:"role,omitempty"`
+}
+
+// LastAccess returns the time the artifact was last requested, which is its
+// creation if it has not been requested since.
+func (a Artifact) LastAccess() time.Time {
+	if a.Accessed.After(a.Created) {
+		return a.Accessed
+	}
+	return a.Created
+}
+
+// Manifest lists the artifacts stored for an id.
+type Manifest struct {
+	Artifacts map[string]Artifact `json:"artifacts"`
+}
+
+// Cache stores media artifacts below a directory using one folder per id.
+// Artifacts are written to temporary files and renamed once complete, so a
+// crash never leaves a truncated file behind.
+type Cache struct {
+	dir     string
+	m       sync.Mutex
+	flights flight.Group
+	// busy counts the running writes of each id.
+	busy map[string]int
+}
+
+// New returns a cache rooted at dir.
+func New(dir string) *Cache {
+	return &Cache{dir: dir, busy: make(map[string]int)}
+}
+
+// Dir returns the root directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Path returns the location of the named artifact of id.
+func (c *Cache) Path(id, name string) string {
+	return filepath.Join(c.dir, id, name)
+}
+
+// Lookup returns the path of the named artifact of id if it is complete.
+func (c *Cache) Lookup(id, name string) (string, bool) {
+	c.m.Lock()
+	m, err := c.readManifest(id)
+	c.m.Unlock()
+	if err != nil {
+		return "", false
+	}
+
+	a, ok := m.Artifacts[name]
+	if !ok || !a.Complete {
+		return "", false
+	}
+
+	p := c.Path(id, name)
+	fi, err := os.Stat(p)
+	if err != nil || fi.Size() != a.Size {
+		return "", false
+	}
+	return p, true
+}
+
+// Artifact returns the path of the named artifact of id. If it is not cached
+// yet, fn is called to write it and the artifact is stored with the given
+// role. Concurrent calls for the same artifact share a single execution of
+// fn.
+func (c *Cache) Artifact(ctx context.Context, id, name, role string, fn func(ctx context.Context, w io.Writer) error) (string, error) {
+	if err := validate(id, name); err != nil {
+		return "", err
+	}
+
+	v, err := c.flights.Do(ctx, id+"/"+name, func(ctx context.Context) (interface{}, error) {
+		if p, ok := c.Lookup(id, name); ok {
+			log.Printf("artifact already exists: %s/%s", id, name)
+			return p, nil
+		}
+
+		// artifacts read by fn must not be removed meanwhile
+		defer c.hold(id)()
+		return c.create(ctx, id, name, role, fn)
+	})
+	if err != nil {
+		return "", err
+	}
+	c.touch(id, name)
+	return v.(string), nil
+}
+
+// hold marks id as busy until the returned function is called.
+func (c *Cache) hold(id string) func() {
+	c.m.Lock()
+	c.busy[id]++
+	c.m.Unlock()
+
+	return func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.busy[id]--; c.busy[id] == 0 {
+			delete(c.busy, id)
+		}
+	}
+}
+
+// Busy reports whether artifacts of id are being written.
+func (c *Cache) Busy(id string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.busy[id] > 0
+}
+
+// touch records an access of the named artifact of id.
+func (c *Cache) touch(id, name string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	m, err := c.readManifest(id)
+	if err != nil {
+		log.Printf("failed to record access of %s/%s: %v", id, name, err)
+		return
+	}
+	a, ok := m.Artifacts[name]
+	if !ok || time.Since(a.LastAccess()) < touchInterval {
+		return
+	}
+
+	a.Accessed = time.Now()
+	m.Artifacts[name] = a
+	if err := c.writeManifest(id, m); err != nil {
+		log.Printf("failed to record access of %s/%s: %v", id, name, err)
+	}
+}
+
+func (c *Cache) create(ctx context.Context, id, name, role string, fn func(ctx context.Context, w io.Writer) error) (string, error) {
+	dir := filepath.Join(c.dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	if err := c.update(id, func(m *Manifest) {
+		m.Artifacts[name] = Artifact{Created: time.Now(), Role: role}
+	}); err != nil {
+		return "", err
+	}
+
+	p, err := c.write(ctx, id, name, role, fn)
+	if err != nil {
+		if err := c.update(id, func(m *Manifest) { delete(m.Artifacts, name) }); err != nil {
+			log.Printf("failed to update manifest: %v", err)
+		}
+		return "", err
+	}
+	return p, nil
+}
+
+// Rewrite replaces the complete named artifact of id with the output of fn,
+// which reads the current version from r. The artifact keeps its role. Open
+// readers keep the previous version.
+func (c *Cache) Rewrite(ctx context.Context, id, name string, fn func(ctx context.Context, r io.Reader, w io.Writer) error) error {
+	if err := validate(id, name); err != nil {
+		return err
+	}
+
+	_, err := c.flights.Do(ctx, id+"/"+name+"#rewrite", func(ctx context.Context) (interface{}, error) {
+		p, ok := c.Lookup(id, name)
+		if !ok {
+			return nil, fmt.Errorf("artifact is not cached: %s/%s", id, name)
+		}
+		m, err := c.Manifest(id)
+		if err != nil {
+			return nil, err
+		}
+
+		defer c.hold(id)()
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open artifact: %v", err)
+		}
+		defer f.Close()
+
+		return c.write(ctx, id, name, m.Artifacts[name].Role, func(ctx context.Context, w io.Writer) error {
+			return fn(ctx, f, w)
+		})
+	})
+	return err
+}
+
+// write stores the output of fn in a temporary file and renames it into
+// place once it is complete and synced.
+func (c *Cache) write(ctx context.Context, id, name, role string, fn func(ctx context.Context, w io.Writer) error) (string, error) {
+	dir := filepath.Join(c.dir, id)
+	f, err := ioutil.TempFile(dir, "."+name+".*"+partSuffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmp := f.Name()
+
+	fail := func(err error) (string, error) {
+		f.Close()
+		if err := os.Remove(tmp); err != nil {
+			log.Printf("failed to delete temporary file: %v", err)
+		}
+		return "", err
+	}
+
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(f, h)}
+	if err := fn(ctx, cw); err != nil {
+		return fail(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync artifact: %v", err))
+	}
+	if err := f.Close(); err != nil {
+		return fail(fmt.Errorf("failed to close artifact: %v", err))
+	}
+
+	p := c.Path(id, name)
+	if err := os.Rename(tmp, p); err != nil {
+		return fail(fmt.Errorf("failed to commit artifact: %v", err))
+	}
+	if err := syncDir(dir); err != nil {
+		log.Printf("failed to sync cache directory: %v", err)
+	}
+
+	if err := c.update(id, func(m *Manifest) {
+		m.Artifacts[name] = Artifact{
+			Size:     cw.n,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+			Complete: true,
+			Created:  time.Now(),
+			Role:     role,
+		}
+	}); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+// Put atomically stores data as the named artifact of id with the given role,
+// replacing any previous version.
+func (c *Cache) Put(id, name, role string, data []byte) error {
+	if err := validate(id, name); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.dir, id), 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if err := WriteFile(c.Path(id, name), data); err != nil {
+		return fmt.Errorf("failed to write artifact: %v", err)
+	}
+
+	m, err := c.readManifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	m.Artifacts[name] = Artifact{
+		Size:     int64(len(data)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Complete: true,
+		Created:  time.Now(),
+		Role:     role,
+	}
+	return c.writeManifest(id, m)
+}
+
+// Remove deletes the complete named artifact of id. Artifacts which are
+// being written are left alone, as are all artifacts of id while others are
+// written from them, which fails with ErrBusy. Open readers keep the removed
+// file.
+func (c *Cache) Remove(id, name string) error {
+	if err := validate(id, name); err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.busy[id] > 0 {
+		return ErrBusy
+	}
+	m, err := c.readManifest(id)
+	if err != nil {
+		return err
+	}
+	a, ok := m.Artifacts[name]
+	if !ok {
+		return fmt.Errorf("artifact is not cached: %s/%s", id, name)
+	}
+	if !a.Complete {
+		return fmt.Errorf("artifact is being written: %s/%s", id, name)
+	}
+
+	if err := os.Remove(c.Path(id, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove artifact: %v", err)
+	}
+	delete(m.Artifacts, name)
+	return c.writeManifest(id, m)
+}
+
+// Prune deletes the folder of id if it holds no artifacts. It reports
+// whether the folder has been deleted.
+func (c *Cache) Prune(id string) (bool, error) {
+	if !validKey(id) {
+		return false, errors.New("invalid cache key")
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	m, err := c.readManifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(m.Artifacts) > 0 {
+		return false, nil
+	}
+
+	if err := os.RemoveAll(filepath.Join(c.dir, id)); err != nil {
+		return false, fmt.Errorf("failed to remove cache directory: %v", err)
+	}
+	return true, nil
+}
+
+// IDs returns all ids stored in the cache.
+func (c *Cache) IDs() ([]string, error) {
+	dirs, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	var ids []string
+	for _, d := range dirs {
+		if d.IsDir() {
+			ids = append(ids, d.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Manifest returns the manifest of id.
+func (c *Cache) Manifest(id string) (Manifest, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.readManifest(id)
+}
+
+// Sweep removes partial artifacts from the cache. Files without a complete
+// manifest entry, such as those written before manifests existed, are adopted
+// as they are.
+func (c *Cache) Sweep() error {
+	dirs, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if err := c.sweep(d.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) sweep(id string) error {
+	dir := filepath.Join(c.dir, id)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	// a broken manifest is kept for inspection and its artifacts are adopted
+	m, err := c.readManifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("quarantining manifest: %v", err)
+		if err := os.Rename(c.Path(id, manifestName), c.Path(id, brokenName)); err != nil {
+			return fmt.Errorf("failed to quarantine manifest: %v", err)
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, f := range files {
+		name := f.Name()
+		if name == manifestName || name == brokenName || f.IsDir() {
+			continue
+		}
+
+		// temporary files are hidden
+		p := filepath.Join(dir, name)
+		if strings.HasPrefix(name, ".") {
+			if strings.HasSuffix(name, partSuffix) {
+				log.Printf("removing partial artifact: %s", p)
+				if err := os.Remove(p); err != nil {
+					return fmt.Errorf("failed to remove partial artifact: %v", err)
+				}
+			}
+			continue
+		}
+
+		if a, ok := m.Artifacts[name]; ok && a.Complete && a.Size == f.Size() {
+			present[name] = true
+			continue
+		}
+
+		// artifacts are renamed into place once complete, so only files
+		// written before manifests existed may be truncated
+		if f.Size() == 0 {
+			log.Printf("ignoring empty artifact: %s", p)
+			continue
+		}
+		a, err := checksum(p)
+		if err != nil {
+			return err
+		}
+		log.Printf("adopting artifact: %s", p)
+		m.Artifacts[name] = a
+		present[name] = true
+	}
+
+	for name := range m.Artifacts {
+		if !present[name] {
+			delete(m.Artifacts, name)
+		}
+	}
+
+	return c.writeManifest(id, m)
+}
+
+// update applies fn to the manifest of id and writes it back.
+func (c *Cache) update(id string, fn func(m *Manifest)) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	m, err := c.readManifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fn(&m)
+	return c.writeManifest(id, m)
+}
+
+// readManifest returns the manifest of id. If it does not exist, an empty
+// manifest is returned along with the error. The caller must hold the lock.
+func (c *Cache) readManifest(id string) (Manifest, error) {
+	m := Manifest{Artifacts: make(map[string]Artifact)}
+
+	b, err := ioutil.ReadFile(c.Path(id, manifestName))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("failed to decode manifest of %s: %v", id, err)
+	}
+	if m.Artifacts == nil {
+		m.Artifacts = make(map[string]Artifact)
+	}
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest of id. The caller must hold
+// the lock.
+func (c *Cache) writeManifest(id string, m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := WriteFile(c.Path(id, manifestName), b); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// WriteFile atomically replaces the file at p with data.
+func WriteFile(p string, data []byte) error {
+	dir := filepath.Dir(p)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(p)+".*"+partSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checksum describes the complete artifact stored at p.
+func checksum(p string) (Artifact, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to open artifact: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to read artifact: %v", err)
+	}
+
+	a := Artifact{Size: n, SHA256: hex.EncodeToString(h.Sum(nil)), Complete: true}
+	if fi, err := f.Stat(); err == nil {
+		a.Created = fi.ModTime()
+	}
+	return a, nil
+}
+
+func validate(id, name string) error {
+	if !validKey(id) || !validKey(name) {
+		return errors.New("invalid cache key")
+	}
+	if name == manifestName || name == brokenName || strings.HasPrefix(name, ".") {
+		return errors.New("invalid artifact name")
+	}
+	return nil
+}
+
+// validKey reports whether s can be used as a name inside the cache.
+func validKey(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
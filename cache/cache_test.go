@@ -0,0 +1,138 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestSweep(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		adopted  []string
+		removed  []string
+		kept     []string
+		manifest bool
+	}{
+		{
+			name: "legacy folder",
+			files: map[string]string{
+				"video.mp4":    "video",
+				"audio.mp3":    "audio",
+				"combined.mp4": "combined",
+			},
+			adopted: []string{"video.mp4", "audio.mp3", "combined.mp4"},
+		},
+		{
+			name: "partial files",
+			files: map[string]string{
+				manifestName:             `{"artifacts":{"audio.mp3":{"size":5,"sha256":"x","complete":true}}}`,
+				"audio.mp3":              "audio",
+				".video.mp4.123.part":    "vid",
+				".manifest.json.42.part": "{",
+				".hidden":                "data",
+			},
+			adopted: []string{"audio.mp3"},
+			removed: []string{".video.mp4.123.part", ".manifest.json.42.part"},
+			kept:    []string{".hidden"},
+		},
+		{
+			name: "incomplete entry",
+			files: map[string]string{
+				manifestName: `{"artifacts":{"audio.mp3":{"complete":false},"gone.mp3":{"size":1,"complete":true}}}`,
+				"audio.mp3":  "audio",
+			},
+			adopted: []string{"audio.mp3"},
+		},
+		{
+			name: "broken manifest",
+			files: map[string]string{
+				manifestName: `{"artifacts":`,
+				"audio.mp3":  "audio",
+			},
+			adopted:  []string{"audio.mp3"},
+			kept:     []string{brokenName},
+			manifest: true,
+		},
+		{
+			name: "empty legacy file",
+			files: map[string]string{
+				"audio.mp3": "",
+			},
+			kept: []string{"audio.mp3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "cache")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			c := New(root)
+			writeFiles(t, filepath.Join(root, "id"), tt.files)
+			if err := c.Sweep(); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := c.Manifest("id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Artifacts) != len(tt.adopted) {
+				t.Errorf("got %d artifacts, want %d", len(m.Artifacts), len(tt.adopted))
+			}
+			for _, name := range tt.adopted {
+				a, ok := m.Artifacts[name]
+				if !ok || !a.Complete || a.Size != int64(len(tt.files[name])) || a.SHA256 == "" {
+					t.Errorf("artifact %s not adopted: %+v", name, a)
+				}
+				if _, ok := c.Lookup("id", name); !ok {
+					t.Errorf("lookup of %s failed", name)
+				}
+			}
+			for _, name := range tt.removed {
+				if exists(c.Path("id", name)) {
+					t.Errorf("%s has not been removed", name)
+				}
+			}
+			for _, name := range tt.kept {
+				if !exists(c.Path("id", name)) {
+					t.Errorf("%s has been removed", name)
+				}
+			}
+			if tt.manifest {
+				b, err := ioutil.ReadFile(c.Path("id", brokenName))
+				if err != nil || string(b) != tt.files[manifestName] {
+					t.Errorf("got quarantined manifest %q, %v", b, err)
+				}
+			}
+		})
+	}
+}
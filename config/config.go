@@ -7,7 +7,12 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+
+	"kohlbau.de/x/jaye/feed"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/retention"
 )
 
 // Config contains the configuration of the just another youtube extractor.
@@ -15,12 +20,32 @@ type Config struct {
 	Server struct {
 		Host string `json:"host"`
 		Port string `json:"port"`
+		// PublicURL is the URL under which clients reach the server.
+		PublicURL string `json:"public_url"`
 	} `json:"server"`
-	Youtube struct {
-		URL       string `json:"url"`
-		Token     string `json:"token"`
-		VideoPath string `json:"video_path"`
-	} `json:"youtube"`
+	// Services maps the name of each enabled service to its configuration.
+	Services map[string]json.RawMessage `json:"services"`
+	// Youtube is the configuration of the youtube service used before
+	// services were configured individually. It is moved into Services.
+	Youtube json.RawMessage `json:"youtube,omitempty"`
+	Library struct {
+		Path string `json:"path"`
+	} `json:"library"`
+	Feed feed.Meta `json:"feed"`
+	// Presets are named audio encodings clients can request.
+	Presets map[string]multimedia.Spec `json:"presets"`
+	Jobs    struct {
+		Workers   int `json:"workers"`
+		QueueSize int `json:"queue_size"`
+	} `json:"jobs"`
+	Subscriptions struct {
+		Path string `json:"path"`
+		// Interval is the time between checks for new uploads, e.g. 1h.
+		Interval string `json:"interval"`
+	} `json:"subscriptions"`
+	// Retention describes which cached files are removed to limit the disk
+	// usage of all services.
+	Retention retention.Policy `json:"retention"`
 }
 
 // FromFile returns a configuration parsed from the given file.
@@ -35,5 +60,36 @@ func FromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if len(cfg.Youtube) > 0 {
+		if cfg.Services == nil {
+			cfg.Services = make(map[string]json.RawMessage)
+		}
+		if _, ok := cfg.Services["youtube"]; !ok {
+			cfg.Services["youtube"] = cfg.Youtube
+		}
+		cfg.Youtube = nil
+	}
+
+	for name, spec := range cfg.Presets {
+		if err := spec.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid preset %s: %v", name, err)
+		}
+	}
+
+	if err := cfg.Retention.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention policy: %v", err)
+	}
+
+	if cfg.Library.Path == "" {
+		cfg.Library.Path = "./library.json"
+	}
+
+	if cfg.Subscriptions.Path == "" {
+		cfg.Subscriptions.Path = "./subscriptions.json"
+	}
+	if cfg.Subscriptions.Interval == "" {
+		cfg.Subscriptions.Interval = "1h"
+	}
+
 	return &cfg, nil
 }
@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package feed
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/library"
+)
+
+// audioName is the file of library items which is published in feeds.
+const audioName = "audio.mp3"
+
+// Meta describes a podcast feed.
+type Meta struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Image       string `json:"image"`
+}
+
+// Filter selects the library items of a feed. Empty fields match all items.
+type Filter struct {
+	Service string
+	Channel string
+	Tag     string
+}
+
+func (f Filter) match(it library.Item) bool {
+	if f.Service != "" && it.Service != f.Service {
+		return false
+	}
+	if f.Channel != "" && !strings.EqualFold(it.Channel, f.Channel) {
+		return false
+	}
+	if f.Tag == "" {
+		return true
+	}
+	for _, t := range it.Tags {
+		if strings.EqualFold(t, f.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+type rss struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Itunes  string   `xml:"xmlns:itunes,attr"`
+	Channel channel  `xml:"channel"`
+}
+
+type channel struct {
+	Title       string      `xml:"title"`
+	Link        string      `xml:"link"`
+	Description string      `xml:"description"`
+	Language    string      `xml:"language,omitempty"`
+	Author      string      `xml:"itunes:author,omitempty"`
+	Summary     string      `xml:"itunes:summary,omitempty"`
+	Image       *itunesLink `xml:"itunes:image,omitempty"`
+	Explicit    string      `xml:"itunes:explicit"`
+	Items       []item      `xml:"item"`
+}
+
+type itunesLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type item struct {
+	Title       string      `xml:"title"`
+	Link        string      `xml:"link,omitempty"`
+	Description string      `xml:"description"`
+	GUID        guid        `xml:"guid"`
+	PubDate     string      `xml:"pubDate"`
+	Enclosure   enclosure   `xml:"enclosure"`
+	Author      string      `xml:"itunes:author,omitempty"`
+	Duration    string      `xml:"itunes:duration,omitempty"`
+	Summary     string      `xml:"itunes:summary,omitempty"`
+	Image       *itunesLink `xml:"itunes:image,omitempty"`
+	Keywords    string      `xml:"itunes:keywords,omitempty"`
+}
+
+type guid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type enclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// Write encodes an RSS 2.0 podcast feed of all items matching f which have
+// been converted to audio. Enclosures link to the audio endpoint below base.
+func Write(w io.Writer, meta Meta, base string, f Filter, items []library.Item) error {
+	var sel []library.Item
+	for _, it := range items {
+		if _, ok := it.File(audioName); ok && f.match(it) {
+			sel = append(sel, it)
+		}
+	}
+
+	// newest episodes first
+	sort.SliceStable(sel, func(i, j int) bool { return date(sel[i]).After(date(sel[j])) })
+
+	title := meta.Title
+	if title == "" {
+		title = "JAYE"
+	}
+	switch {
+	case f.Channel != "":
+		title = fmt.Sprintf("%s - %s", title, f.Channel)
+	case f.Tag != "":
+		title = fmt.Sprintf("%s - %s", title, f.Tag)
+	}
+
+	ch := channel{
+		Title:       title,
+		Link:        base,
+		Description: meta.Description,
+		Author:      meta.Author,
+		Summary:     meta.Description,
+		Explicit:    "no",
+	}
+	if ch.Description == "" {
+		ch.Description = "Videos downloaded by JAYE"
+	}
+	if meta.Image != "" {
+		ch.Image = &itunesLink{Href: meta.Image}
+	} else if len(sel) > 0 && sel[0].Thumbnail != "" {
+		ch.Image = &itunesLink{Href: sel[0].Thumbnail}
+	}
+
+	for _, it := range sel {
+		ch.Items = append(ch.Items, newItem(base, it))
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(rss{
+		Version: "2.0",
+		Itunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: ch,
+	})
+}
+
+func newItem(base string, it library.Item) item {
+	file, _ := it.File(audioName)
+
+	q := url.Values{}
+	q.Set("service", it.Service)
+	q.Set("id", it.VideoID())
+
+	i := item{
+		Title:       it.Title,
+		Link:        it.URL,
+		Description: it.Description,
+		GUID:        guid{Value: it.Service + "/" + it.ID},
+		PubDate:     date(it).Format(time.RFC1123Z),
+		Enclosure: enclosure{
+			URL:    strings.TrimSuffix(base, "/") + "/audio?" + q.Encode(),
+			Length: file.Size,
+			Type:   "audio/mpeg",
+		},
+		Author:   it.Channel,
+		Summary:  it.Description,
+		Keywords: strings.Join(it.Tags, ","),
+	}
+	if it.Duration > 0 {
+		i.Duration = duration(it.Duration)
+	}
+	if it.Thumbnail != "" {
+		i.Image = &itunesLink{Href: it.Thumbnail}
+	}
+	return i
+}
+
+// date returns the publishing date of an episode, which falls back to the
+// download date if the original one is unknown.
+func date(it library.Item) time.Time {
+	if !it.Published.IsZero() {
+		return it.Published
+	}
+	return it.Downloaded
+}
+
+// duration formats seconds as HH:MM:SS.
+func duration(sec int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package flight
+
+import (
+	"context"
+	"sync"
+)
+
+type call struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Group coalesces concurrent calls for the same key into a single execution.
+type Group struct {
+	m     sync.Mutex
+	calls map[string]*call
+}
+
+// Do executes fn once for all concurrent callers using the same key and
+// hands its result to each of them. The context passed to fn is cancelled
+// only after every caller has given up waiting.
+func (g *Group) Do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	g.m.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	c, ok := g.calls[key]
+	if !ok {
+		cctx, cancel := context.WithCancel(context.Background())
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+
+		go func() {
+			c.val, c.err = fn(cctx)
+
+			g.m.Lock()
+			g.forget(key, c)
+			g.m.Unlock()
+
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.m.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.m.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// later callers must not join the cancelled call
+			g.forget(key, c)
+			c.cancel()
+		}
+		g.m.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes c if it is still the current call for key. The caller must
+// hold the lock.
+func (g *Group) forget(key string, c *call) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package flight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wait fails the test if c is not closed within a few seconds.
+func wait(t *testing.T, c <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestDoCoalesces(t *testing.T) {
+	var g Group
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := g.Do(context.Background(), "key", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	wait(t, started, "call")
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+	for i, v := range results {
+		if v != "value" {
+			t.Errorf("caller %d got %v, want value", i, v)
+		}
+	}
+}
+
+func TestDoSharesErrors(t *testing.T) {
+	var g Group
+	want := errors.New("failed")
+	_, err := g.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return nil, want
+	})
+	if err != want {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+
+	// failed calls are not remembered
+	v, err := g.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "retried", nil
+	})
+	if err != nil || v != "retried" {
+		t.Errorf("got %v, %v, want retried", v, err)
+	}
+}
+
+func TestDoKeepsCallForRemainingWaiters(t *testing.T) {
+	var g Group
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return "value", nil
+		case <-ctx.Done():
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "key", fn)
+		first <- err
+	}()
+	wait(t, started, "call")
+
+	second := make(chan interface{}, 1)
+	go func() {
+		v, _ := g.Do(context.Background(), "key", fn)
+		second <- v
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("got error %v for cancelled caller, want %v", err, context.Canceled)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("call was cancelled although a caller is waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if v := <-second; v != "value" {
+		t.Errorf("got %v for waiting caller, want value", v)
+	}
+}
+
+func TestDoCancelsWithoutWaiters(t *testing.T) {
+	var g Group
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		})
+		done <- err
+	}()
+	wait(t, started, "call")
+
+	cancel()
+	wait(t, cancelled, "cancellation")
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// later callers start a new call instead of joining the cancelled one
+	v, err := g.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "new", nil
+	})
+	if err != nil || v != "new" {
+		t.Errorf("got %v, %v, want new", v, err)
+	}
+}
@@ -7,8 +7,6 @@ import { HttpEventType } from '@angular/common/http';
 
 import { VideoService, VideoInfo } from '../../shared/video';
 
-import { Observable } from 'rxjs/Observable';
-
 @Component({
   selector: 'app-download',
   templateUrl: './download.html',
@@ -33,11 +31,7 @@ export class Download implements OnInit {
       .switchMap(query => {
         return this.videoService.search(query)
       })
-      .flatMap((ids: Array<String>) => {
-        return Observable.forkJoin(
-          ids.map((id: string) => this.videoService.info(id)));
-      })
-      .subscribe(videos => {
+      .subscribe((videos: Array<VideoInfo>) => {
         if (videos.length > 0)
           this.selectedVideo = videos[0].id;
 
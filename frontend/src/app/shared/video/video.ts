@@ -19,6 +19,56 @@ export interface VideoInfo {
     url: string;
     thumbnail: string;
     service: string;
+    channel: string;
+    description: string;
+    tags: Array<string>;
+    language: string;
+    duration: number;
+    published: string;
+    chapters: Array<Chapter>;
+    subtitles: Array<string>;
+    formats: Array<Format>;
+    artifacts: Array<Artifact>;
+}
+
+export interface Chapter {
+    title: string;
+    start: number;
+    end: number;
+}
+
+export interface Format {
+    id: string;
+    extension: string;
+    resolution: string;
+    video_codec: string;
+    audio_codec: string;
+    bitrate: number;
+    audio_bitrate: number;
+    size: number;
+}
+
+export interface Artifact {
+    name: string;
+    size: number;
+}
+
+export interface SearchResult {
+    items: Array<VideoInfo>;
+    next_page_token: string;
+    page_size: number;
+    total_results: number;
+}
+
+export interface Progress {
+    id: string;
+    stage: string;
+    unit: string;
+    current: number;
+    total: number;
+    percent: number;
+    done: boolean;
+    error: string;
 }
 
 Injectable()
@@ -61,18 +111,33 @@ export class VideoService {
         return this.http.get<Response>("/info?service=youtube&id=" + id).map(res => <VideoInfo>res.response);
     }
 
-    search(query: string): Observable<Array<String>> {
+    search(query: string): Observable<Array<VideoInfo>> {
         if (query == "")
-            return Observable.create(obs => obs.next(Array<String>()));
+            return Observable.create(obs => obs.next(Array<VideoInfo>()));
 
         let id = this.idFromURL(query);
         if (id != "") {
-            return Observable.create(obs => obs.next(Array<String>(id)));
+            return this.info(id).map(video => Array<VideoInfo>(video));
         }
 
-        return this.http.get<Response>("/search?service=youtube&q=" + encodeURI(query))
+        return this.http.get<Response>("/search?service=youtube&q=" + encodeURIComponent(query))
         .map(data => {
-            return <Array<string>>data.response;
+            return (<SearchResult>data.response).items;
+        });
+    }
+
+    progress(id: string): Observable<Progress> {
+        return Observable.create(obs => {
+            let source = new EventSource(environment.apiEndpoint + "/events?id=" + id);
+            source.addEventListener('progress', (e: MessageEvent) => {
+                let p = <Progress>JSON.parse(e.data);
+                obs.next(p);
+                if (p.done) {
+                    obs.complete();
+                }
+            });
+            source.onerror = err => obs.error(err);
+            return () => source.close();
         });
     }
 
@@ -0,0 +1,95 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/services"
+)
+
+// chapter describes a chapter of a video along with the location of its
+// audio file.
+type chapter struct {
+	Track int `json:"track"`
+	multimedia.Chapter
+	URL string `json:"url"`
+}
+
+// chapters lists the chapters of a video. If an archive is requested, the
+// audio files of all chapters are streamed as zip or tar archive instead.
+func (h handler) chapters(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if r.Method != http.MethodGet {
+		return nil, http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+	if !s.Capabilities().Audio {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	opts, err := h.options(r, s)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if opts.Chapter > 0 || !opts.Clip.IsZero() {
+		return nil, http.StatusBadRequest, errors.New("chapters can not be limited to a clip or chapter")
+	}
+
+	vi, err := s.Info(r.Context(), id)
+	if err != nil {
+		log.Printf("failed to retrieve video info: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+	}
+	if len(vi.Chapters) == 0 {
+		return nil, http.StatusNotFound, errors.New("video has no chapters")
+	}
+
+	if r.FormValue("archive") == "" {
+		q := url.Values{}
+		for k, v := range r.Form {
+			q[k] = v
+		}
+
+		chs := make([]chapter, len(vi.Chapters))
+		for i, ch := range vi.Chapters {
+			q.Set("chapter", strconv.Itoa(i+1))
+			chs[i] = chapter{Track: i + 1, Chapter: ch, URL: h.baseURL(r) + "/audio?" + q.Encode()}
+		}
+		return chs, http.StatusOK, nil
+	}
+
+	format, err := archiveFormat(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	entries := make([]entry, len(vi.Chapters))
+	for i, ch := range vi.Chapters {
+		opts := opts
+		opts.Chapter = i + 1
+		entries[i] = entry{
+			id:    strconv.Itoa(i + 1),
+			title: ch.Title,
+			name:  fmt.Sprintf("%02d - %s.%s", i+1, fileName(ch.Title, strconv.Itoa(i+1)), opts.AudioExtension()),
+			fetch: func(ctx context.Context) (io.ReadCloser, error) { return s.AudioFile(ctx, id, opts) },
+		}
+	}
+
+	writeArchive(w, r, fileName(vi.Title, "chapters"), format, entries)
+	return nil, http.StatusOK, nil
+}
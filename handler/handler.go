@@ -11,20 +11,52 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"kohlbau.de/x/jaye/feed"
+	"kohlbau.de/x/jaye/jobs"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/retention"
 	"kohlbau.de/x/jaye/services"
+	"kohlbau.de/x/jaye/subscriptions"
 )
 
-func New(yt services.Service) http.Handler {
+// New returns the handler serving the API. Audio files are encoded using the
+// named presets on request. Feeds link to publicURL, which is derived from
+// each request if empty.
+func New(reg *services.Registry, lib *library.Store, q *jobs.Queue, subs *subscriptions.Manager, ret *retention.Manager, events *progress.Broker, presets map[string]multimedia.Spec, meta feed.Meta, publicURL string) http.Handler {
 	mux := http.NewServeMux()
-	h := handler{yt: yt}
+	h := handler{registry: reg, library: lib, q: q, subs: subs, retention: ret, events: events, presets: presets, meta: meta, publicURL: publicURL}
 	mux.HandleFunc("/search", h.serviceHandler(search))
 	mux.HandleFunc("/info", h.serviceHandler(info))
-	mux.HandleFunc("/video", h.serviceHandler(video))
-	mux.HandleFunc("/audio", h.serviceHandler(audio))
+	mux.HandleFunc("/video", h.serviceHandler(h.video))
+	mux.HandleFunc("/audio", h.serviceHandler(h.audio))
 	mux.HandleFunc("/list", h.serviceHandler(list))
+	mux.HandleFunc("/playlist", h.serviceHandler(h.playlist))
+	mux.HandleFunc("/retag", h.serviceHandler(h.retag))
+	mux.HandleFunc("/chapters", h.serviceHandler(h.chapters))
+	mux.HandleFunc("/subtitles", h.serviceHandler(h.subtitles))
+	mux.HandleFunc("/transcript", h.serviceHandler(h.transcript))
+	mux.HandleFunc("/jobs", h.serviceHandler(h.submitJob))
+	mux.HandleFunc("/jobs/", h.jobHandler)
+	mux.HandleFunc("/subscriptions", h.subscriptionsHandler)
+	mux.HandleFunc("/subscriptions/", h.subscriptionHandler)
+	mux.HandleFunc("/events", h.eventHandler)
+	mux.HandleFunc("/services", h.servicesHandler)
+	mux.HandleFunc("/feed.xml", h.feedHandler)
+	mux.HandleFunc("/library/search", h.librarySearchHandler)
+	mux.HandleFunc("/library/pin", h.pinHandler)
+	mux.HandleFunc("/library/bulk", h.bulkHandler)
+	mux.HandleFunc("/library/", h.itemHandler)
+	mux.HandleFunc("/retention", h.retentionHandler)
 	return mux
 }
 
@@ -34,12 +66,52 @@ type response struct {
 }
 
 type handler struct {
-	yt services.Service
+	registry  *services.Registry
+	library   *library.Store
+	q         *jobs.Queue
+	subs      *subscriptions.Manager
+	retention *retention.Manager
+	events    *progress.Broker
+	presets   map[string]multimedia.Spec
+	meta      feed.Meta
+	publicURL string
 }
 
 type writer interface {
 	io.Writer
 	Header() http.Header
+	WriteHeader(int)
+}
+
+// file is implemented by cached media files which can be served with support
+// for range and conditional requests.
+type file interface {
+	io.ReadSeeker
+	Stat() (os.FileInfo, error)
+}
+
+// serveFile writes the media in rc using the given file name and content
+// type. Range and conditional requests are answered if rc is a file.
+func serveFile(w writer, r *http.Request, rc io.Reader, name, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Disposition, Content-Length, Content-Range, ETag, Last-Modified")
+
+	f, ok := rc.(file)
+	if !ok {
+		io.Copy(w, rc)
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("failed to stat media file: %v", err)
+		io.Copy(w, rc)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size()))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
 }
 
 func (h handler) serviceHandler(fn func(writer, *http.Request, services.Service) (interface{}, int, error)) http.HandlerFunc {
@@ -51,44 +123,117 @@ func (h handler) serviceHandler(fn func(writer, *http.Request, services.Service)
 			return
 		}
 
-		var data interface{}
-		var status int
-		var err error
-
-		switch service {
-		case "youtube":
-			data, status, err = fn(w, r, h.yt)
-		default:
-			data = nil
-			status = http.StatusBadRequest
-			err = errors.New("service not found")
+		s, ok := h.registry.Get(service)
+		if !ok {
+			respond(w, nil, http.StatusBadRequest, errors.New("service not found"))
+			return
 		}
 
-		if err != nil {
-			data = err.Error()
-		}
+		data, status, err := fn(w, r, s)
+		respond(w, data, status, err)
+	}
+}
 
-		// used if handler does not use json
-		if data == nil {
-			return
-		}
+func respond(w http.ResponseWriter, data interface{}, status int, err error) {
+	if err != nil {
+		data = err.Error()
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(status)
-		err = json.NewEncoder(w).Encode(response{Data: data, Success: err == nil})
-		if err != nil {
-			log.Printf("could not encode response to output: %v", err)
-		}
+	// used if handler does not use json
+	if data == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(response{Data: data, Success: err == nil})
+	if err != nil {
+		log.Printf("could not encode response to output: %v", err)
+	}
+}
+
+type serviceDescription struct {
+	Name         string                `json:"name"`
+	Capabilities services.Capabilities `json:"capabilities"`
+}
+
+func (h handler) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	descs := []serviceDescription{}
+	for _, name := range h.registry.Names() {
+		s, _ := h.registry.Get(name)
+		descs = append(descs, serviceDescription{Name: name, Capabilities: s.Capabilities()})
+	}
+
+	respond(w, descs, http.StatusOK, nil)
+}
+
+func (h handler) feedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	f := feed.Filter{
+		Service: r.FormValue("service"),
+		Channel: r.FormValue("channel"),
+		Tag:     r.FormValue("tag"),
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	if err := feed.Write(w, h.meta, h.baseURL(r), f, h.library.All()); err != nil {
+		log.Printf("could not encode feed: %v", err)
 	}
 }
 
+// baseURL returns the URL under which the API is reachable by clients.
+func (h handler) baseURL(r *http.Request) string {
+	if h.publicURL != "" {
+		return strings.TrimSuffix(h.publicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func (h handler) jobHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" {
+		respond(w, nil, http.StatusBadRequest, errors.New("no job id supplied"))
+		return
+	}
+	if strings.HasSuffix(id, "/archive") {
+		data, status, err := h.jobArchive(w, r, strings.TrimSuffix(id, "/archive"))
+		respond(w, data, status, err)
+		return
+	}
+
+	j, ok := h.q.Get(id)
+	if !ok {
+		respond(w, nil, http.StatusNotFound, fmt.Errorf("job not found: %s", url.QueryEscape(id)))
+		return
+	}
+
+	respond(w, j, http.StatusOK, nil)
+}
+
 func info(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
 	id := r.FormValue("id")
 	if id == "" {
 		return nil, http.StatusBadRequest, errors.New("no id supplied")
 	}
 
-	vid, err := s.Info(r.Context(), url.QueryEscape(id))
+	vid, err := s.Info(r.Context(), id)
 	if err != nil {
 		log.Printf("failed to retrieve video info: %v", err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to retrieve video info: %s", url.QueryEscape(id))
@@ -98,74 +243,374 @@ func info(w writer, r *http.Request, s services.Service) (interface{}, int, erro
 }
 
 func search(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
-	q := r.FormValue("q")
-	if q == "" {
+	if !s.Capabilities().Search {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	q, err := query(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if q.Text == "" {
 		return nil, http.StatusBadRequest, errors.New("missing query parameter")
 	}
 
-	vids, err := s.Search(r.Context(), url.QueryEscape(q))
+	res, err := s.Search(r.Context(), q)
 	if err != nil {
-		log.Printf("failed to find youtube video: %v", err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to find youtube video for query: %s", url.QueryEscape(q))
+		log.Printf("failed to find video: %v", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to find video for query: %s", url.QueryEscape(q.Text))
+	}
+
+	return res, http.StatusOK, nil
+}
+
+// query reads a search from the form values of r. Dates are given either as
+// RFC 3339 timestamps or as plain dates.
+func query(r *http.Request) (services.Query, error) {
+	q := services.Query{
+		Text:      r.FormValue("q"),
+		PageToken: r.FormValue("page_token"),
+		Duration:  r.FormValue("duration"),
+		Order:     r.FormValue("order"),
+		Channel:   r.FormValue("channel"),
+	}
+
+	if v := r.FormValue("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid page_size: %v", err)
+		}
+		q.PageSize = n
 	}
 
-	return vids, http.StatusOK, nil
+	for name, field := range map[string]*time.Time{"published_after": &q.After, "published_before": &q.Before} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+		}
+		if err != nil {
+			return q, fmt.Errorf("invalid %s: %s", name, v)
+		}
+		*field = t
+	}
+
+	return q, q.Validate()
 }
 
-func video(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+func (h handler) video(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if !s.Capabilities().Video {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
 	id := r.FormValue("id")
 	if id == "" {
 		return nil, http.StatusBadRequest, errors.New("no id supplied")
 	}
 
-	rc, err := s.VideoFile(r.Context(), id)
+	opts, err := h.options(r, s)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := opts.ValidateVideo(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	rc, err := s.VideoFile(r.Context(), id, opts)
 	if err != nil {
 		log.Printf("failed to retrieve video file: %v", err)
 		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video file")
 	}
 	defer rc.Close()
 
-	vi, err := s.Info(r.Context(), id)
+	if r.Header.Get("Accept") == "application/json" {
+		vi, err := s.Info(r.Context(), id)
+		if err != nil {
+			log.Printf("failed to retrieve video info: %v", err)
+			return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+		}
+		return vi, http.StatusOK, nil
+	}
+
+	title, err := h.title(r, s, id)
 	if err != nil {
 		log.Printf("failed to retrieve video info: %v", err)
 		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
 	}
 
-	if r.Header.Get("Accept") == "application/json" {
-		return vi, http.StatusOK, nil
-	}
-
-	w.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.mp4\"", vi.Title))
-	io.Copy(w, rc)
+	serveFile(w, r, rc, partName(title, opts)+".mp4", "video/mp4")
 	return nil, http.StatusOK, nil
 }
 
-func audio(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+func (h handler) audio(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if !s.Capabilities().Audio {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
 	id := r.FormValue("id")
 	if id == "" {
 		return nil, http.StatusBadRequest, errors.New("no id supplied")
 	}
 
-	rc, err := s.AudioFile(r.Context(), id)
+	opts, err := h.options(r, s)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	rc, err := s.AudioFile(r.Context(), id, opts)
+	if err == services.ErrNoChapter {
+		return nil, http.StatusNotFound, err
+	}
 	if err != nil {
 		log.Printf("failed to retrieve audio file: %v", err)
 		return nil, http.StatusInternalServerError, errors.New("failed to retrieve audio file")
 	}
 	defer rc.Close()
 
+	if r.Header.Get("Accept") == "application/json" {
+		vi, err := s.Info(r.Context(), id)
+		if err != nil {
+			log.Printf("failed to retrieve video info: %v", err)
+			return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+		}
+		return vi, http.StatusOK, nil
+	}
+
+	title, err := h.title(r, s, id)
+	if err != nil {
+		log.Printf("failed to retrieve video info: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+	}
+
+	contentType := opts.Output.MIMEType()
+	if opts.Container != "" {
+		contentType = containerType(opts.Container)
+	}
+	serveFile(w, r, rc, partName(title, opts)+"."+opts.AudioExtension(), contentType)
+	return nil, http.StatusOK, nil
+}
+
+// retag rewrites the tags of the converted files of a video from its library
+// metadata.
+func (h handler) retag(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if r.Method != http.MethodPost {
+		return nil, http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	rt, ok := s.(services.Retagger)
+	if !ok {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	if err := rt.Retag(r.Context(), id); err != nil {
+		log.Printf("failed to retag files: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retag files")
+	}
+
 	vi, err := s.Info(r.Context(), id)
 	if err != nil {
 		log.Printf("failed to retrieve video info: %v", err)
 		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
 	}
+	return vi, http.StatusOK, nil
+}
 
-	if r.Header.Get("Accept") == "application/json" {
-		return vi, http.StatusOK, nil
+// partName adds the range of clips or the number of chapters to the file
+// name title.
+func partName(title string, opts services.Options) string {
+	switch {
+	case opts.Chapter > 0:
+		return fmt.Sprintf("%s - %02d", title, opts.Chapter)
+	case !opts.Clip.IsZero():
+		return fmt.Sprintf("%s (%s)", title, opts.Clip)
 	}
+	return title
+}
 
-	w.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.mp3\"", vi.Title))
-	io.Copy(w, rc)
-	return nil, http.StatusOK, nil
+// options reads the variant of a file from the form values of r. Services
+// which do not support options only accept the default stream selection. The
+// output encoding is taken from a preset, its format can be overridden.
+func (h handler) options(r *http.Request, s services.Service) (services.Options, error) {
+	opts := services.Options{
+		Container: strings.ToLower(r.FormValue("container")),
+		Codec:     strings.ToLower(r.FormValue("codec")),
+	}
+
+	if name := r.FormValue("preset"); name != "" {
+		spec, ok := h.presets[name]
+		if !ok {
+			return opts, fmt.Errorf("unknown preset: %s", url.QueryEscape(name))
+		}
+		opts.Output = spec
+	}
+	if f := r.FormValue("format"); f != "" {
+		opts.Output.Format = strings.ToLower(f)
+	}
+	if err := filter(r, &opts.Output.Filter); err != nil {
+		return opts, err
+	}
+
+	// qualities may carry their unit, e.g. 720p or 128k
+	for _, o := range []struct {
+		name, unit string
+		field      *int
+	}{
+		{"max_resolution", "p", &opts.MaxResolution},
+		{"audio_bitrate", "k", &opts.AudioBitrate},
+		{"chapter", "", &opts.Chapter},
+	} {
+		v := r.FormValue(o.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(v, o.unit))
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %s", o.name, url.QueryEscape(v))
+		}
+		*o.field = n
+	}
+
+	if v := r.FormValue("subtitles"); v != "" {
+		opts.Subtitles = strings.Split(v, ",")
+	}
+	opts.BurnSubtitles = r.FormValue("burn_subtitles")
+	if (len(opts.Subtitles) > 0 || opts.BurnSubtitles != "") && !s.Capabilities().Subtitles {
+		return opts, services.ErrNotSupported
+	}
+
+	if !opts.Selection().Unclipped().IsZero() && !s.Capabilities().Options {
+		return opts, services.ErrNotSupported
+	}
+
+	clip, err := clip(r)
+	if err != nil {
+		return opts, err
+	}
+	opts.Clip = clip
+
+	return opts, opts.Validate()
+}
+
+// filter overrides the audio filter f with the form values of r.
+func filter(r *http.Request, f *multimedia.Filter) error {
+	if v := r.FormValue("loudness"); v != "" {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "lufs"))
+		if err != nil {
+			return fmt.Errorf("invalid loudness: %s", url.QueryEscape(v))
+		}
+		f.Loudness = n
+	}
+	if v := r.FormValue("trim_silence"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid trim_silence: %s", url.QueryEscape(v))
+		}
+		f.TrimSilence = b
+	}
+	if v := r.FormValue("tempo"); v != "" {
+		t, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+		if err != nil {
+			return fmt.Errorf("invalid tempo: %s", url.QueryEscape(v))
+		}
+		f.Tempo = t
+	}
+	if v := r.FormValue("high_pass"); v != "" {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "hz"))
+		if err != nil {
+			return fmt.Errorf("invalid high_pass: %s", url.QueryEscape(v))
+		}
+		f.HighPass = n
+	}
+	return nil
+}
+
+// clip reads the time range of a clip from the form values start and end or
+// duration.
+func clip(r *http.Request) (multimedia.Range, error) {
+	var rng multimedia.Range
+	var dur time.Duration
+	for name, field := range map[string]*time.Duration{"start": &rng.Start, "end": &rng.End, "duration": &dur} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		d, err := offset(v)
+		if err != nil {
+			return rng, fmt.Errorf("invalid %s: %s", name, url.QueryEscape(v))
+		}
+		*field = d
+	}
+
+	if dur != 0 {
+		if rng.End != 0 {
+			return rng, errors.New("either end or duration may be given")
+		}
+		if dur < 0 {
+			return rng, errors.New("duration must be positive")
+		}
+		rng.End = rng.Start + dur
+	}
+	return rng, rng.Validate()
+}
+
+// offset parses a position within a media file given in seconds, as
+// timestamp like 1:02:03.5 or as duration like 1m30s. It is rounded to
+// milliseconds.
+func offset(v string) (time.Duration, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return d.Round(time.Millisecond), nil
+	}
+
+	parts := strings.Split(v, ":")
+	if len(parts) > 3 {
+		return 0, errors.New("invalid timestamp")
+	}
+
+	var d time.Duration
+	for i, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil || n < 0 || (i > 0 && n >= 60) {
+			return 0, errors.New("invalid timestamp")
+		}
+		d = d*60 + time.Duration(n*float64(time.Second))
+	}
+	return d.Round(time.Millisecond), nil
+}
+
+// containerType returns the content type of audio streams served in their
+// container.
+func containerType(container string) string {
+	switch container {
+	case "m4a", "mp4":
+		return "audio/mp4"
+	case "webm":
+		return "audio/webm"
+	case "ogg", "opus":
+		return "audio/ogg"
+	}
+	return "application/octet-stream"
+}
+
+// title returns the title of id, preferring the library over a service
+// lookup.
+func (h handler) title(r *http.Request, s services.Service, id string) (string, error) {
+	if it, ok := h.library.Find(r.FormValue("service"), id); ok {
+		return it.Title, nil
+	}
+
+	vi, err := s.Info(r.Context(), id)
+	if err != nil {
+		return "", err
+	}
+	return vi.Title, nil
 }
 
 func list(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
@@ -175,3 +620,193 @@ func list(w writer, r *http.Request, s services.Service) (interface{}, int, erro
 	}
 	return videos, http.StatusOK, nil
 }
+
+// keepAlive is the interval in which comments are sent to idle event streams.
+const keepAlive = 15 * time.Second
+
+func (h handler) eventHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	id := r.FormValue("id")
+	if id == "" {
+		respond(w, nil, http.StatusBadRequest, errors.New("no id supplied"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respond(w, nil, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	events, cancel := h.events.Subscribe(id)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("could not encode event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+		}
+		flusher.Flush()
+	}
+}
+
+func (h handler) submitJob(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if r.Method != http.MethodPost {
+		return nil, http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	kind := jobs.Kind(r.FormValue("kind"))
+	switch {
+	case kind == jobs.Audio && s.Capabilities().Audio:
+	case kind == jobs.Video && s.Capabilities().Video:
+	default:
+		return nil, http.StatusBadRequest, errors.New("kind must be audio or video and supported by the service")
+	}
+
+	opts, err := h.options(r, s)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if kind == jobs.Video {
+		if err := opts.ValidateVideo(); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	j, err := h.q.Submit(s, r.FormValue("service"), id, kind, opts)
+	if err == jobs.ErrQueueFull || err == jobs.ErrClosed {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		log.Printf("failed to submit job: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to submit job")
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	return j, http.StatusAccepted, nil
+}
+
+func (h handler) subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodGet:
+		respond(w, h.subs.List(), http.StatusOK, nil)
+	case http.MethodPost:
+		sub, err := subscription(r)
+		if err != nil {
+			respond(w, nil, http.StatusBadRequest, err)
+			return
+		}
+
+		if svc, ok := h.registry.Get(sub.Service); ok {
+			sub.Options, err = h.options(r, svc)
+			if err != nil {
+				respond(w, nil, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		sub, err = h.subs.Add(sub)
+		if err == subscriptions.ErrExists {
+			respond(w, nil, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			respond(w, nil, http.StatusBadRequest, err)
+			return
+		}
+
+		w.Header().Set("Location", "/subscriptions/"+sub.ID)
+		respond(w, sub, http.StatusCreated, nil)
+	default:
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h handler) subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodDelete {
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
+	if id == "" {
+		respond(w, nil, http.StatusBadRequest, errors.New("no subscription id supplied"))
+		return
+	}
+
+	err := h.subs.Remove(id)
+	if err == subscriptions.ErrNotFound {
+		respond(w, nil, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to remove subscription: %v", err)
+		respond(w, nil, http.StatusInternalServerError, errors.New("failed to remove subscription"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscription reads a new subscription from the form values of r. Durations
+// are given in Go syntax such as 10m.
+func subscription(r *http.Request) (subscriptions.Subscription, error) {
+	sub := subscriptions.Subscription{
+		Service:      r.FormValue("service"),
+		Source:       r.FormValue("source"),
+		Target:       r.FormValue("target"),
+		Kind:         jobs.Kind(r.FormValue("kind")),
+		TitlePattern: r.FormValue("title_pattern"),
+	}
+
+	for name, field := range map[string]*int64{"min_duration": &sub.MinDuration, "max_duration": &sub.MaxDuration} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return sub, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*field = int64(d / time.Second)
+	}
+
+	if v := r.FormValue("backfill"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return sub, fmt.Errorf("invalid backfill: %v", err)
+		}
+		sub.Backfill = n
+	}
+
+	return sub, nil
+}
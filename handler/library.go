@@ -0,0 +1,330 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/retention"
+	"kohlbau.de/x/jaye/services"
+)
+
+const (
+	// defaultLimit is the number of search results returned if no limit is
+	// requested.
+	defaultLimit = 20
+	// maxLimit is the maximum number of search results returned at once.
+	maxLimit = 100
+)
+
+type searchResults struct {
+	Total   int              `json:"total"`
+	Results []library.Result `json:"results"`
+}
+
+// librarySearchHandler searches the metadata and transcripts of the
+// downloaded items, optionally restricted to a service.
+func (h handler) librarySearchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	service := r.FormValue("service")
+	if _, ok := h.registry.Get(service); service != "" && !ok {
+		respond(w, nil, http.StatusBadRequest, errors.New("service not found"))
+		return
+	}
+
+	limit, offset := defaultLimit, 0
+	for name, field := range map[string]*int{"limit": &limit, "offset": &offset} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respond(w, nil, http.StatusBadRequest, fmt.Errorf("invalid %s: %s", name, v))
+			return
+		}
+		*field = n
+	}
+	if limit == 0 || limit > maxLimit {
+		respond(w, nil, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxLimit))
+		return
+	}
+
+	results, err := h.library.Search(service, r.FormValue("q"))
+	if err != nil {
+		respond(w, nil, http.StatusBadRequest, err)
+		return
+	}
+
+	res := searchResults{Total: len(results), Results: []library.Result{}}
+	if offset < len(results) {
+		results = results[offset:]
+		if len(results) > limit {
+			results = results[:limit]
+		}
+		res.Results = results
+	}
+	respond(w, res, http.StatusOK, nil)
+}
+
+// pinHandler pins a downloaded item on POST requests, so the retention
+// policy never removes its files, and unpins it on DELETE requests.
+func (h handler) pinHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var pinned bool
+	switch r.Method {
+	case http.MethodPost:
+		pinned = true
+	case http.MethodDelete:
+	default:
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	service, id := r.FormValue("service"), r.FormValue("id")
+	if service == "" || id == "" {
+		respond(w, nil, http.StatusBadRequest, errors.New("service and id must be supplied"))
+		return
+	}
+
+	it, err := h.retention.Pin(service, id, pinned)
+	if err == retention.ErrNotFound {
+		respond(w, nil, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to pin item: %v", err)
+		respond(w, nil, http.StatusInternalServerError, errors.New("failed to pin item"))
+		return
+	}
+	respond(w, it, http.StatusOK, nil)
+}
+
+// maxBulk is the maximum number of items changed by a single bulk request.
+const maxBulk = 1000
+
+// curator returns the service managing the item with the given library id
+// or video id.
+func (h handler) curator(service, id string) (services.Curator, library.Item, int, error) {
+	s, ok := h.registry.Get(service)
+	if !ok {
+		return nil, library.Item{}, http.StatusBadRequest, errors.New("service not found")
+	}
+	c, ok := s.(services.Curator)
+	if !ok || !s.Capabilities().Manage {
+		return nil, library.Item{}, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	it, ok := h.library.Get(service, id)
+	if !ok {
+		if it, ok = h.library.Find(service, id); !ok {
+			return nil, library.Item{}, http.StatusNotFound, services.ErrNotDownloaded
+		}
+	}
+	return c, it, http.StatusOK, nil
+}
+
+// curatorStatus returns the status code of errors returned by a Curator.
+func curatorStatus(err error) int {
+	switch err {
+	case services.ErrNotDownloaded:
+		return http.StatusNotFound
+	case services.ErrInUse:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// itemHandler serves /library/{service}/{id}. GET requests return the item,
+// PATCH requests edit its title, tags and notes and DELETE requests remove
+// the files listed as file or the whole item.
+func (h handler) itemHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/library/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		respond(w, nil, http.StatusNotFound, errors.New("item not found"))
+		return
+	}
+
+	c, it, status, err := h.curator(parts[0], parts[1])
+	if err != nil {
+		respond(w, nil, status, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		respond(w, it, http.StatusOK, nil)
+	case http.MethodPatch:
+		e, err := edit(r)
+		if err != nil {
+			respond(w, nil, http.StatusBadRequest, err)
+			return
+		}
+		updated, err := c.Update(r.Context(), it.VideoID(), e)
+		if err != nil {
+			log.Printf("failed to update %s: %v", it.ID, err)
+			respond(w, nil, curatorStatus(err), errors.New("failed to update item"))
+			return
+		}
+		respond(w, updated, http.StatusOK, nil)
+	case http.MethodDelete:
+		if err := r.ParseForm(); err != nil {
+			respond(w, nil, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.Remove(r.Context(), it.VideoID(), r.Form["file"]...); err != nil {
+			if status := curatorStatus(err); status != http.StatusInternalServerError {
+				respond(w, nil, status, err)
+				return
+			}
+			log.Printf("failed to remove %s: %v", it.ID, err)
+			respond(w, nil, http.StatusInternalServerError, errors.New("failed to remove item"))
+			return
+		}
+
+		// the item is gone once its last file is removed
+		if it, ok := h.library.Get(it.Service, it.ID); ok {
+			respond(w, it, http.StatusOK, nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// edit reads the changes of an item from a JSON body or the form values
+// title, notes and the comma separated tags, add_tags and remove_tags.
+func edit(r *http.Request) (services.Edit, error) {
+	var e services.Edit
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			return e, fmt.Errorf("failed to decode edit: %v", err)
+		}
+		return e, e.Validate()
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return e, err
+	}
+	if v, ok := r.Form["title"]; ok {
+		e.Title = &v[0]
+	}
+	if v, ok := r.Form["notes"]; ok {
+		e.Notes = &v[0]
+	}
+	if v, ok := r.Form["tags"]; ok {
+		tags := splitTags(v[0])
+		e.Tags = &tags
+	}
+	e.AddTags = splitTags(r.Form.Get("add_tags"))
+	e.RemoveTags = splitTags(r.Form.Get("remove_tags"))
+	return e, e.Validate()
+}
+
+// splitTags splits a comma separated list of tags. An empty list results in
+// no tags.
+func splitTags(v string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+type bulkRequest struct {
+	// Action is one of delete, update, pin or unpin.
+	Action string     `json:"action"`
+	Items  []bulkItem `json:"items"`
+	// Files are the names of the files deleted from each item. All files
+	// are deleted if it is empty.
+	Files []string      `json:"files"`
+	Edit  services.Edit `json:"edit"`
+}
+
+type bulkItem struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+}
+
+type bulkResult struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkHandler applies an action to many items at once. Failures of single
+// items are listed in the results without affecting the others.
+func (h handler) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodPost {
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respond(w, nil, http.StatusBadRequest, fmt.Errorf("failed to decode request: %v", err))
+		return
+	}
+	switch req.Action {
+	case "delete", "pin", "unpin":
+	case "update":
+		if err := req.Edit.Validate(); err != nil {
+			respond(w, nil, http.StatusBadRequest, err)
+			return
+		}
+	default:
+		respond(w, nil, http.StatusBadRequest, errors.New("action must be delete, update, pin or unpin"))
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBulk {
+		respond(w, nil, http.StatusBadRequest, fmt.Errorf("between 1 and %d items must be supplied", maxBulk))
+		return
+	}
+
+	results := make([]bulkResult, len(req.Items))
+	for i, item := range req.Items {
+		results[i] = bulkResult{Service: item.Service, ID: item.ID}
+
+		c, it, _, err := h.curator(item.Service, item.ID)
+		if err == nil {
+			switch req.Action {
+			case "delete":
+				err = c.Remove(r.Context(), it.VideoID(), req.Files...)
+			case "update":
+				_, err = c.Update(r.Context(), it.VideoID(), req.Edit)
+			case "pin", "unpin":
+				_, err = h.retention.Pin(it.Service, it.VideoID(), req.Action == "pin")
+			}
+		}
+		if err != nil {
+			if curatorStatus(err) == http.StatusInternalServerError {
+				log.Printf("failed to %s %s/%s: %v", req.Action, item.Service, item.ID, err)
+			}
+			results[i].Error = err.Error()
+		}
+	}
+
+	respond(w, results, http.StatusOK, nil)
+}
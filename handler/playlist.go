@@ -0,0 +1,288 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/jobs"
+	"kohlbau.de/x/jaye/services"
+)
+
+// maxArchive is the maximum number of files streamed as one archive.
+const maxArchive = 500
+
+// playlist expands a playlist of the service and submits a batch job fetching
+// all videos. Once it has finished, the files are served as an archive by
+// jobArchive.
+func (h handler) playlist(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	if r.Method != http.MethodPost {
+		return nil, http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	pl, ok := s.(services.Playlister)
+	if !ok || !s.Capabilities().Playlists {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	kind := jobs.Kind(r.FormValue("kind"))
+	switch {
+	case kind == jobs.Audio && s.Capabilities().Audio:
+	case kind == jobs.Video && s.Capabilities().Video:
+	default:
+		return nil, http.StatusBadRequest, errors.New("kind must be audio or video and supported by the service")
+	}
+
+	opts, err := h.options(r, s)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if kind == jobs.Video {
+		if err := opts.ValidateVideo(); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	uploads, err := pl.Playlist(r.Context(), id)
+	if err != nil {
+		log.Printf("failed to expand playlist: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to expand playlist")
+	}
+	if len(uploads) == 0 {
+		return nil, http.StatusNotFound, errors.New("playlist is empty")
+	}
+
+	items := make([]jobs.Item, len(uploads))
+	for i, u := range uploads {
+		items[i] = jobs.Item{VideoID: u.ID, Title: u.Title}
+	}
+
+	j, err := h.q.SubmitBatch(s, r.FormValue("service"), id, kind, opts, items)
+	if err == jobs.ErrQueueFull || err == jobs.ErrClosed {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		log.Printf("failed to submit batch: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to submit batch")
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	return j, http.StatusAccepted, nil
+}
+
+// jobArchive streams the files fetched by the batch job id as a zip or tar
+// archive. Only items the job has fetched are included, so nothing is
+// downloaded while streaming. Jobs which have not finished yet are answered
+// with a conflict.
+func (h handler) jobArchive(w writer, r *http.Request, id string) (interface{}, int, error) {
+	format, err := archiveFormat(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	j, ok := h.q.Get(id)
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("job not found: %s", url.QueryEscape(id))
+	}
+	if len(j.Items) == 0 {
+		return nil, http.StatusBadRequest, errors.New("job is not a batch job")
+	}
+	if j.State == jobs.Queued || j.State == jobs.Running {
+		return j, http.StatusConflict, nil
+	}
+
+	s, ok := h.registry.Get(j.Service)
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("service not found: %s", url.QueryEscape(j.Service))
+	}
+	fetch, ext := s.AudioFile, "."+j.Options.AudioExtension()
+	if j.Kind == jobs.Video {
+		fetch, ext = s.VideoFile, ".mp4"
+	}
+
+	var entries []entry
+	for i, it := range j.Items {
+		if it.State != jobs.Done {
+			continue
+		}
+		it := it
+		entries = append(entries, entry{
+			id:    it.VideoID,
+			title: it.Title,
+			name:  fmt.Sprintf("%03d - %s%s", i+1, fileName(it.Title, it.VideoID), ext),
+			fetch: func(ctx context.Context) (io.ReadCloser, error) { return fetch(ctx, it.VideoID, j.Options) },
+		})
+	}
+	if len(entries) == 0 {
+		return nil, http.StatusNotFound, errors.New("job has not fetched any files")
+	}
+	if len(entries) > maxArchive {
+		return nil, http.StatusBadRequest, fmt.Errorf("archives are limited to %d files", maxArchive)
+	}
+
+	writeArchive(w, r, j.VideoID, format, entries)
+	return nil, http.StatusOK, nil
+}
+
+// archive writes the entries of a zip or tar stream.
+type archive interface {
+	add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	// media files are compressed already
+	fh := &zip.FileHeader{Name: name, Method: zip.Store}
+	fh.SetModTime(modTime)
+	w, err := a.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := io.Copy(a, r)
+	return err
+}
+
+// archiveFormat returns the archive format requested by the form value
+// archive, which defaults to zip. The form value format selects the encoding
+// of audio files instead.
+func archiveFormat(r *http.Request) (string, error) {
+	switch f := r.FormValue("archive"); f {
+	case "":
+		return "zip", nil
+	case "zip", "tar":
+		return f, nil
+	}
+	return "", errors.New("archive must be zip or tar")
+}
+
+// entry is a file of an archive which is fetched once it is written.
+type entry struct {
+	id    string
+	title string
+	name  string
+	fetch func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// writeArchive fetches the entries one after another and writes them to an
+// archive called name. Entries which fail are skipped and listed in the file
+// errors.txt at the end of the archive.
+func writeArchive(w writer, r *http.Request, name, format string, entries []entry) {
+	var a archive
+	var contentType string
+	switch format {
+	case "zip":
+		a, contentType = zipArchive{zip.NewWriter(w)}, "application/zip"
+	case "tar":
+		a, contentType = tarArchive{tar.NewWriter(w)}, "application/x-tar"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+
+	var failed bytes.Buffer
+	for _, e := range entries {
+		rc, err := e.fetch(r.Context())
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			log.Printf("failed to fetch %s for archive: %v", e.id, err)
+			fmt.Fprintf(&failed, "%s\t%s\t%v\n", e.id, e.title, err)
+			continue
+		}
+
+		err = addFile(a, rc, e.name)
+		rc.Close()
+		if err != nil {
+			// the archive is broken once an entry was written partially
+			log.Printf("failed to write archive: %v", err)
+			return
+		}
+	}
+
+	if failed.Len() > 0 {
+		if err := a.add("errors.txt", int64(failed.Len()), time.Now(), &failed); err != nil {
+			log.Printf("failed to write archive: %v", err)
+			return
+		}
+	}
+
+	if err := a.Close(); err != nil {
+		log.Printf("failed to write archive: %v", err)
+	}
+}
+
+// addFile adds the media in rc to the archive.
+func addFile(a archive, rc io.Reader, name string) error {
+	if f, ok := rc.(file); ok {
+		if fi, err := f.Stat(); err == nil {
+			return a.add(name, fi.Size(), fi.ModTime(), rc)
+		}
+	}
+
+	// tar headers require the size up front
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return a.add(name, int64(len(b)), time.Now(), bytes.NewReader(b))
+}
+
+// fileName returns title without characters that are invalid in file names,
+// or id if nothing is left.
+func fileName(title, id string) string {
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < ' ' {
+			return -1
+		}
+		return r
+	}, title)
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return id
+	}
+	return name
+}
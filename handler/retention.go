@@ -0,0 +1,42 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// retentionHandler returns the report of the last run of the retention
+// policy on GET requests. POST requests apply the policy right away, or
+// report the files which would be removed if dry_run is set.
+func (h handler) retentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodGet:
+		report, ok := h.retention.Last()
+		if !ok {
+			respond(w, nil, http.StatusNotFound, errors.New("retention policy has not been applied yet"))
+			return
+		}
+		respond(w, report, http.StatusOK, nil)
+	case http.MethodPost:
+		dryRun := false
+		if v := r.FormValue("dry_run"); v != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				respond(w, nil, http.StatusBadRequest, fmt.Errorf("invalid dry_run: %v", err))
+				return
+			}
+		}
+		respond(w, h.retention.Collect(r.Context(), dryRun), http.StatusOK, nil)
+	default:
+		respond(w, nil, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
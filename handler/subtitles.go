@@ -0,0 +1,72 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"kohlbau.de/x/jaye/services"
+)
+
+// subtitles lists the subtitle tracks of a video. If a language is given, the
+// subtitle is served as WebVTT or SRT file instead.
+func (h handler) subtitles(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	st, ok := s.(services.Subtitler)
+	if !ok || !s.Capabilities().Subtitles {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	lang := r.FormValue("lang")
+	if lang == "" {
+		subs, err := st.Subtitles(r.Context(), id)
+		if err != nil {
+			log.Printf("failed to retrieve subtitles: %v", err)
+			return nil, http.StatusInternalServerError, errors.New("failed to retrieve subtitles")
+		}
+		return subs, http.StatusOK, nil
+	}
+	if err := services.ValidateLanguage(lang); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	format := r.FormValue("format")
+	var contentType string
+	switch format {
+	case "", services.WebVTT:
+		format, contentType = services.WebVTT, "text/vtt; charset=utf-8"
+	case services.SRT:
+		contentType = "application/x-subrip; charset=utf-8"
+	default:
+		return nil, http.StatusBadRequest, errors.New("format must be srt or vtt")
+	}
+
+	rc, err := st.SubtitleFile(r.Context(), id, lang, format)
+	if err == services.ErrNoSubtitle {
+		return nil, http.StatusNotFound, err
+	}
+	if err != nil {
+		log.Printf("failed to retrieve subtitle file: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retrieve subtitle file")
+	}
+	defer rc.Close()
+
+	title, err := h.title(r, s, id)
+	if err != nil {
+		log.Printf("failed to retrieve video info: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+	}
+
+	serveFile(w, r, rc, fmt.Sprintf("%s.%s.%s", title, lang, format), contentType)
+	return nil, http.StatusOK, nil
+}
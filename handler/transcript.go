@@ -0,0 +1,94 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"kohlbau.de/x/jaye/services"
+)
+
+// defaultLanguage is the language of transcripts if none is requested.
+const defaultLanguage = "en"
+
+// transcript returns the transcript of a video as plain text, Markdown or
+// JSON segments. Timestamps are kept if requested.
+func (h handler) transcript(w writer, r *http.Request, s services.Service) (interface{}, int, error) {
+	tr, ok := s.(services.Transcriber)
+	if !ok || !s.Capabilities().Transcripts {
+		return nil, http.StatusBadRequest, services.ErrNotSupported
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("no id supplied")
+	}
+
+	lang := r.FormValue("lang")
+	if lang == "" {
+		lang = defaultLanguage
+	}
+	if err := services.ValidateLanguage(lang); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	timestamps := false
+	if v := r.FormValue("timestamps"); v != "" {
+		var err error
+		if timestamps, err = strconv.ParseBool(v); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid timestamps: %v", err)
+		}
+	}
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "text"
+	case "text", "markdown", "json":
+	default:
+		return nil, http.StatusBadRequest, errors.New("format must be text, markdown or json")
+	}
+
+	t, err := tr.Transcript(r.Context(), id, lang)
+	if err == services.ErrNoSubtitle {
+		return nil, http.StatusNotFound, err
+	}
+	if err != nil {
+		log.Printf("failed to create transcript: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to create transcript")
+	}
+
+	if format == "json" {
+		return t, http.StatusOK, nil
+	}
+
+	title, err := h.title(r, s, id)
+	if err != nil {
+		log.Printf("failed to retrieve video info: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to retrieve video info")
+	}
+
+	var b bytes.Buffer
+	name, contentType := title+".txt", "text/plain; charset=utf-8"
+	if format == "markdown" {
+		name, contentType = title+".md", "text/markdown; charset=utf-8"
+		err = t.WriteMarkdown(&b, title, timestamps)
+	} else {
+		err = t.WriteText(&b, timestamps)
+	}
+	if err != nil {
+		log.Printf("failed to write transcript: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed to write transcript")
+	}
+
+	serveFile(w, r, &b, name, contentType)
+	return nil, http.StatusOK, nil
+}
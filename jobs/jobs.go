@@ -0,0 +1,360 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"kohlbau.de/x/jaye/services"
+)
+
+// State describes the progress of a job.
+type State string
+
+// Possible job states.
+const (
+	Queued  State = "queued"
+	Running State = "running"
+	Done    State = "done"
+	Failed  State = "failed"
+	// Cancelled jobs were still waiting when the queue was closed.
+	Cancelled State = "cancelled"
+)
+
+// Kind describes which file a job produces.
+type Kind string
+
+// Possible job kinds.
+const (
+	Audio Kind = "audio"
+	Video Kind = "video"
+)
+
+var (
+	// ErrQueueFull is returned if no further jobs can be accepted.
+	ErrQueueFull = errors.New("job queue is full")
+	// ErrClosed is returned for jobs submitted after the queue was closed.
+	ErrClosed = errors.New("job queue is closed")
+)
+
+// Job is a snapshot of a background download. Batch jobs fetch all of their
+// items, VideoID is the id of the playlist then.
+type Job struct {
+	ID       string           `json:"id"`
+	Service  string           `json:"service"`
+	VideoID  string           `json:"video_id"`
+	Kind     Kind             `json:"kind"`
+	Options  services.Options `json:"options"`
+	State    State            `json:"state"`
+	Error    string           `json:"error,omitempty"`
+	Items    []Item           `json:"items,omitempty"`
+	Created  time.Time        `json:"created"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+}
+
+// Item is a single video of a batch job.
+type Item struct {
+	VideoID string `json:"video_id"`
+	Title   string `json:"title"`
+	State   State  `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+type job struct {
+	Job
+	svc services.Service
+}
+
+// snapshot returns a copy of the job which does not share its items. The
+// caller must hold the lock of the queue.
+func (j *job) snapshot() Job {
+	c := j.Job
+	c.Items = append([]Item(nil), j.Items...)
+	return c
+}
+
+// Queue runs jobs on a bounded pool of workers.
+type Queue struct {
+	m       sync.Mutex
+	jobs    map[string]*job
+	pending chan *job
+	keep    time.Duration
+	closed  bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a queue running the given number of workers. At most size
+// jobs are waiting at any time.
+func New(workers, size int) *Queue {
+	if workers <= 0 {
+		workers = 1
+	}
+	if size <= 0 {
+		size = 100
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		jobs:    make(map[string]*job),
+		pending: make(chan *job, size),
+		keep:    24 * time.Hour,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// Submit enqueues a job fetching the variant opts of the file of the given
+// kind for id.
+func (q *Queue) Submit(s services.Service, service, id string, kind Kind, opts services.Options) (Job, error) {
+	return q.submit(s, service, id, kind, opts, nil)
+}
+
+// SubmitBatch enqueues a single job fetching the files of the given kind for
+// all items of a playlist one after another.
+func (q *Queue) SubmitBatch(s services.Service, service, playlist string, kind Kind, opts services.Options, items []Item) (Job, error) {
+	if len(items) == 0 {
+		return Job{}, errors.New("batch has no items")
+	}
+
+	batch := make([]Item, len(items))
+	for i, it := range items {
+		batch[i] = Item{VideoID: it.VideoID, Title: it.Title, State: Queued}
+	}
+	return q.submit(s, service, playlist, kind, opts, batch)
+}
+
+func (q *Queue) submit(s services.Service, service, id string, kind Kind, opts services.Options, items []Item) (Job, error) {
+	if kind != Audio && kind != Video {
+		return Job{}, fmt.Errorf("unknown job kind: %q", kind)
+	}
+
+	jid, err := newID()
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to generate job id: %v", err)
+	}
+
+	j := &job{
+		Job: Job{
+			ID:      jid,
+			Service: service,
+			VideoID: id,
+			Kind:    kind,
+			Options: opts,
+			State:   Queued,
+			Items:   items,
+			Created: time.Now(),
+		},
+		svc: s,
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.closed {
+		return Job{}, ErrClosed
+	}
+	q.prune()
+
+	select {
+	case q.pending <- j:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	q.jobs[jid] = j
+
+	return j.snapshot(), nil
+}
+
+// Get returns the job with the given id.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.snapshot(), true
+}
+
+// Close cancels running jobs and waits for all workers to exit. Jobs which
+// are still waiting are cancelled.
+func (q *Queue) Close() {
+	q.m.Lock()
+	q.closed = true
+	q.m.Unlock()
+
+	q.cancel()
+	q.wg.Wait()
+
+	for {
+		select {
+		case j := <-q.pending:
+			q.update(j, func(j *Job) {
+				j.State = Cancelled
+				j.Error = ErrClosed.Error()
+				j.Finished = time.Now()
+				cancelItems(j)
+			})
+		default:
+			return
+		}
+	}
+}
+
+// cancelItems marks the items of a batch job which have not been fetched as
+// cancelled.
+func cancelItems(j *Job) {
+	for i := range j.Items {
+		if j.Items[i].State == Queued {
+			j.Items[i].State = Cancelled
+		}
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case j := <-q.pending:
+			q.run(j)
+		}
+	}
+}
+
+func (q *Queue) run(j *job) {
+	q.update(j, func(j *Job) {
+		j.State = Running
+		j.Started = time.Now()
+	})
+
+	log.Printf("running job %s: %s %s", j.ID, j.Kind, j.VideoID)
+
+	var err error
+	if len(j.Items) > 0 {
+		err = q.batch(j)
+	} else {
+		err = fetch(q.ctx, j.svc, j.VideoID, j.Kind, j.Options)
+	}
+
+	q.update(j, func(j *Job) {
+		j.Finished = time.Now()
+		cancelItems(j)
+		if err != nil {
+			j.State = Failed
+			j.Error = err.Error()
+			return
+		}
+		j.State = Done
+	})
+
+	if err != nil {
+		log.Printf("job %s failed: %v", j.ID, err)
+		return
+	}
+	log.Printf("finished job %s", j.ID)
+}
+
+// batch fetches the items of a batch job. It fails if any item failed, the
+// remaining items are fetched nonetheless.
+func (q *Queue) batch(j *job) error {
+	failed := 0
+	for i := range j.Items {
+		if err := q.ctx.Err(); err != nil {
+			return err
+		}
+
+		q.update(j, func(j *Job) { j.Items[i].State = Running })
+
+		err := fetch(q.ctx, j.svc, j.Items[i].VideoID, j.Kind, j.Options)
+
+		q.update(j, func(j *Job) {
+			if err != nil {
+				j.Items[i].State = Failed
+				j.Items[i].Error = err.Error()
+				return
+			}
+			j.Items[i].State = Done
+		})
+
+		if err != nil {
+			log.Printf("job %s failed to fetch %s: %v", j.ID, j.Items[i].VideoID, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d items failed", failed, len(j.Items))
+	}
+	return nil
+}
+
+func (q *Queue) update(j *job, fn func(*Job)) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	fn(&j.Job)
+}
+
+// prune removes finished jobs which are older than the keep duration. The
+// caller must hold the lock.
+func (q *Queue) prune() {
+	for id, j := range q.jobs {
+		if j.Finished.IsZero() {
+			continue
+		}
+		if time.Since(j.Finished) > q.keep {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// fetch lets the service produce the requested file. The file itself is
+// discarded, it ends up in the service cache and is served from there.
+func fetch(ctx context.Context, s services.Service, id string, kind Kind, opts services.Options) error {
+	var fn func(context.Context, string, services.Options) (io.ReadCloser, error)
+	switch kind {
+	case Audio:
+		fn = s.AudioFile
+	case Video:
+		fn = s.VideoFile
+	}
+
+	rc, err := fn(ctx, id, opts)
+	if err != nil {
+		return err
+	}
+	return rc.Close()
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+)
+
+// ErrNotFound is returned for items which are not in the library.
+var ErrNotFound = errors.New("item not found")
+
+// InfoName is the artifact holding the metadata of an item next to its files.
+const InfoName = "info.json"
+
+// File is a downloaded or converted file of an item.
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Item contains the metadata of a downloaded video.
+type Item struct {
+	Service     string    `json:"service"`
+	ID          string    `json:"id"`
+	Source      string    `json:"source,omitempty"`
+	Title       string    `json:"title"`
+	Channel     string    `json:"channel"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	URL         string    `json:"url"`
+	Thumbnail   string    `json:"thumbnail"`
+	Duration    int64     `json:"duration"` // in seconds
+	Files       []File    `json:"files"`
+	Published   time.Time `json:"published"`
+	Downloaded  time.Time `json:"downloaded"`
+	// Transcripts holds the text of the transcripts created from the
+	// subtitles, by language.
+	Transcripts map[string]string `json:"transcripts,omitempty"`
+	// Pinned items are never removed by the retention policy.
+	Pinned bool `json:"pinned,omitempty"`
+	// Notes are written by users.
+	Notes string `json:"notes,omitempty"`
+}
+
+// VideoID returns the id clients use to request the item from its service.
+// It is the source of the item if the service stores it under a derived key.
+func (it Item) VideoID() string {
+	if it.Source != "" {
+		return it.Source
+	}
+	return it.ID
+}
+
+// File returns the named file of the item.
+func (it Item) File(name string) (File, bool) {
+	for _, f := range it.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+func key(service, id string) string {
+	return service + "/" + id
+}
+
+// Store is an index of all downloaded items persisted as a JSON file. The
+// metadata of the items is kept in a full-text index for searching.
+type Store struct {
+	m      sync.RWMutex
+	record sync.Mutex
+	path   string
+	items  map[string]Item
+	index  *index
+}
+
+// Open loads the store from the file at path. A missing file results in an
+// empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, items: make(map[string]Item), index: newIndex()}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read library: %v", err)
+	}
+
+	var items []Item
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode library: %v", err)
+	}
+	for _, it := range items {
+		k := key(it.Service, it.ID)
+		s.items[k] = it
+		s.index.add(k, it)
+	}
+
+	return s, nil
+}
+
+// Get returns the item with the given id of a service.
+func (s *Store) Get(service, id string) (Item, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	it, ok := s.items[key(service, id)]
+	return it, ok
+}
+
+// Find returns the item of a service which clients request with videoID.
+func (s *Store) Find(service, videoID string) (Item, bool) {
+	if it, ok := s.Get(service, videoID); ok && it.VideoID() == videoID {
+		return it, true
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for _, it := range s.items {
+		if it.Service == service && it.VideoID() == videoID {
+			return it, true
+		}
+	}
+	return Item{}, false
+}
+
+// All returns the items of all services ordered by their download date.
+func (s *Store) All() []Item {
+	return s.List("")
+}
+
+// List returns all items of a service ordered by their download date. An
+// empty service selects all items.
+func (s *Store) List(service string) []Item {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var items []Item
+	for _, it := range s.items {
+		if service == "" || it.Service == service {
+			items = append(items, it)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Downloaded.Before(items[j].Downloaded) })
+	return items
+}
+
+// Put adds or replaces an item.
+func (s *Store) Put(it Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	k := key(it.Service, it.ID)
+	s.items[k] = it
+	s.index.add(k, it)
+	return s.save()
+}
+
+// Delete removes an item.
+func (s *Store) Delete(service, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	k := key(service, id)
+	delete(s.items, k)
+	s.index.remove(k)
+	return s.save()
+}
+
+// Replace swaps all items of a service for the given ones.
+func (s *Store) Replace(service string, items []Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, it := range s.items {
+		if it.Service == service {
+			delete(s.items, k)
+			s.index.remove(k)
+		}
+	}
+	for _, it := range items {
+		k := key(it.Service, it.ID)
+		s.items[k] = it
+		s.index.add(k, it)
+	}
+	return s.save()
+}
+
+// save writes the store to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	items := make([]Item, 0, len(s.items))
+	for _, it := range s.items {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return key(items[i].Service, items[i].ID) < key(items[j].Service, items[j].ID)
+	})
+
+	b, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode library: %v", err)
+	}
+	if err := cache.WriteFile(s.path, b); err != nil {
+		return fmt.Errorf("failed to write library: %v", err)
+	}
+	return nil
+}
+
+// Add records it in the library unless an item with its id exists already,
+// in which case only the file list of the stored item is refreshed. It
+// returns the recorded item.
+func (s *Store) Add(c *cache.Cache, it Item) (Item, error) {
+	s.record.Lock()
+	defer s.record.Unlock()
+
+	if stored, ok := s.Get(it.Service, it.ID); ok {
+		it = stored
+	}
+	return s.store(c, it)
+}
+
+// Modify applies fn to the item with the given id of a service and records
+// the result. The item is read and written while holding the record lock, so
+// concurrent modifications are not lost. It returns the recorded item.
+func (s *Store) Modify(c *cache.Cache, service, id string, fn func(it *Item)) (Item, error) {
+	s.record.Lock()
+	defer s.record.Unlock()
+
+	it, ok := s.Get(service, id)
+	if !ok {
+		return Item{}, ErrNotFound
+	}
+	fn(&it)
+	return s.store(c, it)
+}
+
+// store refreshes the file list of it from c and stores it in the library as
+// well as next to its files, so the library can be rebuilt from disk. Items
+// of services without a cache are only stored in the library. The caller
+// must hold the record lock.
+func (s *Store) store(c *cache.Cache, it Item) (Item, error) {
+	if c == nil {
+		return it, s.Put(it)
+	}
+
+	files, err := Files(c, it.ID)
+	if err != nil {
+		return Item{}, err
+	}
+	it.Files = files
+
+	b, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to encode item: %v", err)
+	}
+	if err := c.Put(it.ID, InfoName, cache.Metadata, b); err != nil {
+		return Item{}, err
+	}
+
+	return it, s.Put(it)
+}
+
+// Current reports whether the item with the given id of a service is in the
+// library and lists the files stored for it in c, in which case there is
+// nothing to record.
+func (s *Store) Current(c *cache.Cache, service, id string) bool {
+	it, ok := s.Get(service, id)
+	if !ok {
+		return false
+	}
+	files, err := Files(c, id)
+	if err != nil || len(files) != len(it.Files) {
+		return false
+	}
+	for i, f := range files {
+		if it.Files[i] != f {
+			return false
+		}
+	}
+	return true
+}
+
+// Refresh updates the file list of the item stored as id in c after files
+// have been removed. Items without any files left are removed from the
+// library along with their metadata and folder.
+func (s *Store) Refresh(service string, c *cache.Cache, id string) error {
+	s.record.Lock()
+	defer s.record.Unlock()
+
+	files, err := Files(c, id)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		it, ok := s.Get(service, id)
+		if !ok {
+			return nil
+		}
+		it.Files = files
+		return s.Put(it)
+	}
+
+	if _, ok := s.Get(service, id); ok {
+		if err := s.Delete(service, id); err != nil {
+			return err
+		}
+	}
+
+	m, err := c.Manifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, ok := m.Artifacts[InfoName]; ok {
+		if err := c.Remove(id, InfoName); err != nil {
+			return err
+		}
+	}
+	_, err = c.Prune(id)
+	return err
+}
+
+// Files returns the complete files stored for id in c.
+func Files(c *cache.Cache, id string) ([]File, error) {
+	m, err := c.Manifest(id)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var files []File
+	for name, a := range m.Artifacts {
+		if name == InfoName || !a.Complete {
+			continue
+		}
+		files = append(files, File{Name: name, Size: a.Size})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Scan rebuilds the items of a service from the files in c. Items without
+// stored metadata are looked up using info.
+func Scan(service string, c *cache.Cache, info func(id string) (Item, error)) ([]Item, error) {
+	ids, err := c.IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	for _, id := range ids {
+		var it Item
+
+		b, err := ioutil.ReadFile(c.Path(id, InfoName))
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &it); err != nil {
+				log.Printf("failed to decode metadata of %s: %v", id, err)
+				continue
+			}
+		case os.IsNotExist(err):
+			it, err = info(id)
+			if err != nil {
+				log.Printf("failed to retrieve metadata of %s: %v", id, err)
+				continue
+			}
+			if fi, err := os.Stat(filepath.Join(c.Dir(), id)); err == nil {
+				it.Downloaded = fi.ModTime()
+			}
+		default:
+			return nil, fmt.Errorf("failed to read metadata of %s: %v", id, err)
+		}
+
+		it.Service = service
+		it.ID = id
+		if it.Files, err = Files(c, id); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"kohlbau.de/x/jaye/cache"
+)
+
+func TestModifyKeepsConcurrentChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(filepath.Join(dir, "cache"))
+	if _, err := s.Add(c, Item{Service: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Modify(c, "test", "a", func(it *Item) {
+				it.Tags = append(it.Tags, strconv.Itoa(i))
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	it, _ := s.Get("test", "a")
+	if len(it.Tags) != 20 {
+		t.Errorf("got %d tags, want 20", len(it.Tags))
+	}
+
+	if _, err := s.Modify(c, "test", "b", func(*Item) {}); err != ErrNotFound {
+		t.Errorf("got error %v for unknown item, want %v", err, ErrNotFound)
+	}
+}
+
+func TestAddKeepsStoredMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(filepath.Join(dir, "cache"))
+	if _, err := s.Add(c, Item{Service: "test", ID: "a", Title: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("a", "audio.mp3", cache.Audio, []byte("audio")); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := s.Add(c, Item{Service: "test", ID: "a", Title: "fetched"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Title != "edited" {
+		t.Errorf("got title %q, want edited", it.Title)
+	}
+	if len(it.Files) != 1 || it.Files[0].Name != "audio.mp3" {
+		t.Errorf("got files %v, want audio.mp3", it.Files)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package library
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrEmptyQuery is returned for search queries without any terms or filters.
+var ErrEmptyQuery = errors.New("empty search query")
+
+// field is a searchable part of an item.
+type field int
+
+const (
+	titleField field = iota
+	channelField
+	tagsField
+	descriptionField
+	transcriptField
+	numFields
+)
+
+var fieldNames = [numFields]string{"title", "channel", "tags", "description", "transcript"}
+
+// fieldWeights rank matches in short, descriptive fields above matches in
+// long texts.
+var fieldWeights = [numFields]float64{3, 2, 2, 1, 0.5}
+
+// parameters of the BM25 ranking function
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// Result is an item matching a search query. Its transcript is left out.
+type Result struct {
+	Item
+	Score float64 `json:"score"`
+	// Matches are the fields containing the search terms.
+	Matches []string `json:"matches"`
+}
+
+// document holds the positions of the terms of an item in each field.
+type document struct {
+	positions map[string]*[numFields][]int
+	lengths   [numFields]int
+}
+
+// index is an inverted index over the metadata of items. It is not safe for
+// concurrent use.
+type index struct {
+	docs     map[string]*document
+	postings map[string]map[string]struct{} // term to document keys
+	lengths  [numFields]int                 // total length of each field
+}
+
+func newIndex() *index {
+	return &index{
+		docs:     make(map[string]*document),
+		postings: make(map[string]map[string]struct{}),
+	}
+}
+
+// transcripts returns the transcripts of it ordered by language.
+func transcripts(it Item) []string {
+	langs := make([]string, 0, len(it.Transcripts))
+	for lang := range it.Transcripts {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	ts := make([]string, len(langs))
+	for i, lang := range langs {
+		ts[i] = it.Transcripts[lang]
+	}
+	return ts
+}
+
+// add indexes it under k, replacing a previous version of the item.
+func (x *index) add(k string, it Item) {
+	x.remove(k)
+
+	d := &document{positions: make(map[string]*[numFields][]int)}
+	texts := [numFields][]string{
+		titleField:       {it.Title},
+		channelField:     {it.Channel},
+		tagsField:        it.Tags,
+		descriptionField: {it.Description},
+		transcriptField:  transcripts(it),
+	}
+	for f, ts := range texts {
+		pos := 0
+		for _, t := range ts {
+			for _, term := range tokenize(t) {
+				p, ok := d.positions[term]
+				if !ok {
+					p = new([numFields][]int)
+					d.positions[term] = p
+				}
+				p[f] = append(p[f], pos)
+				d.lengths[f]++
+				pos++
+			}
+			// phrases do not span multiple tags
+			pos++
+		}
+	}
+
+	for term := range d.positions {
+		keys, ok := x.postings[term]
+		if !ok {
+			keys = make(map[string]struct{})
+			x.postings[term] = keys
+		}
+		keys[k] = struct{}{}
+	}
+	for f, l := range d.lengths {
+		x.lengths[f] += l
+	}
+	x.docs[k] = d
+}
+
+// remove drops the item indexed under k.
+func (x *index) remove(k string) {
+	d, ok := x.docs[k]
+	if !ok {
+		return
+	}
+
+	for term := range d.positions {
+		delete(x.postings[term], k)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	for f, l := range d.lengths {
+		x.lengths[f] -= l
+	}
+	delete(x.docs, k)
+}
+
+// clause is a term or phrase of a query, optionally restricted to a field.
+type clause struct {
+	terms []string
+	field field // numFields matches any field
+}
+
+// parseQuery splits q into clauses. Quoted text is matched as a phrase, just
+// like words joined by punctuation. The prefixes channel: and tag: restrict
+// the following word or phrase to the channel or tags of an item.
+func parseQuery(q string) []clause {
+	var clauses []clause
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		c := clause{field: numFields}
+		if i := strings.IndexAny(q, ": \t\n\""); i > 0 && q[i] == ':' {
+			switch strings.ToLower(q[:i]) {
+			case "channel":
+				c.field, q = channelField, q[i+1:]
+			case "tag":
+				c.field, q = tagsField, q[i+1:]
+			}
+		}
+
+		var text string
+		if strings.HasPrefix(q, "\"") {
+			// an unterminated phrase ends with the query
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				text, q = q[1:], ""
+			} else {
+				text, q = q[1:end+1], q[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				end = len(q)
+			}
+			text, q = q[:end], q[end:]
+		}
+
+		if c.terms = tokenize(text); len(c.terms) > 0 {
+			clauses = append(clauses, c)
+		}
+	}
+	return clauses
+}
+
+// search returns the scores and matched fields of all documents matching
+// every clause. There must be at least one clause.
+func (x *index) search(clauses []clause) map[string]Result {
+	// candidates are the documents containing the rarest term
+	candidates := x.postings[clauses[0].terms[0]]
+	for _, c := range clauses {
+		for _, term := range c.terms {
+			if keys := x.postings[term]; len(keys) < len(candidates) {
+				candidates = keys
+			}
+		}
+	}
+
+	n := float64(len(x.docs))
+	var avg [numFields]float64
+	for f, l := range x.lengths {
+		if n > 0 {
+			avg[f] = float64(l) / n
+		}
+	}
+
+	results := make(map[string]Result)
+	for k := range candidates {
+		d := x.docs[k]
+
+		var score float64
+		var matched [numFields]bool
+		ok := true
+		for _, c := range clauses {
+			counts := d.count(c)
+
+			var total int
+			var s float64
+			for f, tf := range counts {
+				total += tf
+				if tf == 0 {
+					continue
+				}
+				matched[f] = true
+				norm := 1 - b
+				if avg[f] > 0 {
+					norm += b * float64(d.lengths[f]) / avg[f]
+				}
+				s += fieldWeights[f] * float64(tf) * (k1 + 1) / (float64(tf) + k1*norm)
+			}
+			if total == 0 {
+				ok = false
+				break
+			}
+
+			var idf float64
+			for _, term := range c.terms {
+				df := float64(len(x.postings[term]))
+				idf += math.Log(1 + (n-df+0.5)/(df+0.5))
+			}
+			score += idf * s
+		}
+		if !ok {
+			continue
+		}
+
+		r := Result{Score: score}
+		for f, m := range matched {
+			if m {
+				r.Matches = append(r.Matches, fieldNames[f])
+			}
+		}
+		results[k] = r
+	}
+	return results
+}
+
+// count returns the number of occurrences of the phrase of c in each field
+// of the document.
+func (d *document) count(c clause) [numFields]int {
+	var counts [numFields]int
+
+	first, ok := d.positions[c.terms[0]]
+	if !ok {
+		return counts
+	}
+	for f := range first {
+		if c.field != numFields && field(f) != c.field {
+			continue
+		}
+	next:
+		for _, p := range first[f] {
+			for i, term := range c.terms[1:] {
+				pos, ok := d.positions[term]
+				if !ok || !contains(pos[f], p+i+1) {
+					continue next
+				}
+			}
+			counts[f]++
+		}
+	}
+	return counts
+}
+
+// contains reports whether the ascending positions include p.
+func contains(positions []int, p int) bool {
+	i := sort.SearchInts(positions, p)
+	return i < len(positions) && positions[i] == p
+}
+
+// tokenize splits s into lower case words.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Search returns the items of a service matching the query q, best matches
+// first. An empty service searches all items. Items match if they contain
+// all words and phrases of the query in their title, channel, tags,
+// description or transcript.
+func (s *Store) Search(service, q string) ([]Result, error) {
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var results []Result
+	for k, r := range s.index.search(clauses) {
+		it := s.items[k]
+		if service != "" && it.Service != service {
+			continue
+		}
+		it.Transcripts = nil
+		r.Item = it
+		results = append(results, r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		ri, rj := results[i], results[j]
+		if ri.Score != rj.Score {
+			return ri.Score > rj.Score
+		}
+		if !ri.Downloaded.Equal(rj.Downloaded) {
+			return ri.Downloaded.After(rj.Downloaded)
+		}
+		return key(ri.Service, ri.ID) < key(rj.Service, rj.ID)
+	})
+	return results, nil
+}
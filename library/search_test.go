@@ -0,0 +1,140 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		clauses []clause
+	}{
+		{query: "", clauses: nil},
+		{query: "  \t", clauses: nil},
+		{
+			query: "Go generics",
+			clauses: []clause{
+				{terms: []string{"go"}, field: numFields},
+				{terms: []string{"generics"}, field: numFields},
+			},
+		},
+		{
+			query:   `"pull request"`,
+			clauses: []clause{{terms: []string{"pull", "request"}, field: numFields}},
+		},
+		{
+			query:   "pull-request",
+			clauses: []clause{{terms: []string{"pull", "request"}, field: numFields}},
+		},
+		{
+			query: `channel:"go time" tag:Talk`,
+			clauses: []clause{
+				{terms: []string{"go", "time"}, field: channelField},
+				{terms: []string{"talk"}, field: tagsField},
+			},
+		},
+		{
+			query: "CHANNEL:gophers title:go",
+			clauses: []clause{
+				{terms: []string{"gophers"}, field: channelField},
+				{terms: []string{"title", "go"}, field: numFields},
+			},
+		},
+		{
+			query:   `"unterminated phrase`,
+			clauses: []clause{{terms: []string{"unterminated", "phrase"}, field: numFields}},
+		},
+		{
+			query:   `tag:"`,
+			clauses: nil,
+		},
+		{
+			query: `a"b c"`,
+			clauses: []clause{
+				{terms: []string{"a", "b"}, field: numFields},
+				{terms: []string{"c"}, field: numFields},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parseQuery(tt.query); !reflect.DeepEqual(got, tt.clauses) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tt.query, got, tt.clauses)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []Item{
+		{Service: "youtube", ID: "title", Title: "Go generics explained", Channel: "Gophers"},
+		{Service: "youtube", ID: "description", Title: "Weekly news", Channel: "Go Time", Description: "This week: generics in go"},
+		{Service: "direct", ID: "transcript", Title: "Podcast", Transcripts: map[string]string{"en": "we talk about generics and go"}},
+		{Service: "youtube", ID: "tags", Title: "Talk", Tags: []string{"pull request", "review"}},
+	}
+	for _, it := range items {
+		if err := s.Put(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query   string
+		service string
+		ids     []string
+	}{
+		// matches in the title rank above the description and transcript
+		{query: "go generics", ids: []string{"title", "description", "transcript"}},
+		{query: "generics", service: "direct", ids: []string{"transcript"}},
+		{query: `"generics explained"`, ids: []string{"title"}},
+		{query: `"explained generics"`, ids: nil},
+		{query: `channel:"go time"`, ids: []string{"description"}},
+		{query: "channel:go generics", ids: []string{"description"}},
+		{query: `tag:"pull request"`, ids: []string{"tags"}},
+		{query: "tag:talk", ids: nil},
+		{query: `"pull req`, ids: nil},
+		{query: `"pull request`, ids: []string{"tags"}},
+		{query: "rust", ids: nil},
+	}
+
+	for _, tt := range tests {
+		results, err := s.Search(tt.service, tt.query)
+		if err != nil {
+			t.Errorf("search %q: %v", tt.query, err)
+			continue
+		}
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.ID)
+			if r.Transcripts != nil {
+				t.Errorf("search %q: result %s includes its transcripts", tt.query, r.ID)
+			}
+		}
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("search %q: got %s, want %s", tt.query, strings.Join(ids, ","), strings.Join(tt.ids, ","))
+		}
+	}
+
+	if _, err := s.Search("", `"`); err != ErrEmptyQuery {
+		t.Errorf("got error %v for empty query, want %v", err, ErrEmptyQuery)
+	}
+}
@@ -13,14 +13,26 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"kohlbau.de/x/jaye/config"
 	"kohlbau.de/x/jaye/handler"
-	"kohlbau.de/x/jaye/services/youtube"
+	"kohlbau.de/x/jaye/jobs"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/retention"
+	"kohlbau.de/x/jaye/services"
+	"kohlbau.de/x/jaye/subscriptions"
+
+	// Service providers
+	_ "kohlbau.de/x/jaye/services/direct"
+	_ "kohlbau.de/x/jaye/services/local"
+	_ "kohlbau.de/x/jaye/services/youtube"
 )
 
 func main() {
 	configPath := flag.String("config", "./config/config.json", "path to config file")
+	reindex := flag.Bool("reindex", false, "rebuild the library from the downloaded files and exit")
 
 	flag.Parse()
 
@@ -30,13 +42,71 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// YouTube Service
-	ytService := youtube.New(config.Youtube.URL, config.Youtube.Token, config.Youtube.VideoPath)
+	// Progress events
+	events := progress.NewBroker()
+
+	// Library
+	lib, err := library.Open(config.Library.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Services
+	registry := services.NewRegistry()
+	env := services.Env{Library: lib, Events: events}
+	for name, raw := range config.Services {
+		s, err := services.Open(name, raw, env)
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry.Add(name, s)
+	}
+
+	if *reindex {
+		for _, name := range registry.Names() {
+			s, _ := registry.Get(name)
+			ix, ok := s.(services.Indexer)
+			if !ok {
+				continue
+			}
+			log.Printf("Rebuilding library of %s", name)
+			if err := ix.Reindex(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	// Background jobs
+	queue := jobs.New(config.Jobs.Workers, config.Jobs.QueueSize)
+	defer queue.Close()
+
+	// Subscriptions
+	interval, err := time.ParseDuration(config.Subscriptions.Interval)
+	if err != nil {
+		log.Fatalf("invalid subscription interval: %v", err)
+	}
+	subs, err := subscriptions.Open(config.Subscriptions.Path, registry, queue, interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go subs.Run(ctx)
+
+	// Retention
+	ret, err := retention.New(config.Retention, registry, lib)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go ret.Run(ctx)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf("%s:%s", config.Server.Host, config.Server.Port),
-		Handler: handler.New(ytService),
+		Handler: handler.New(registry, lib, queue, subs, ret, events, config.Presets, config.Feed, config.Server.PublicURL),
 	}
+	server.RegisterOnShutdown(events.Close)
+	server.RegisterOnShutdown(cancel)
 
 	go func() {
 		// Graceful shutdown
@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minChapters is the number of markers a description needs to list chapters.
+const minChapters = 2
+
+// Chapter is a named section of a media file. A zero End extends the chapter
+// to the end of the file.
+type Chapter struct {
+	Title string        `json:"title"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end,omitempty"`
+}
+
+// Range returns the time range covered by the chapter.
+func (c Chapter) Range() Range {
+	return Range{Start: c.Start, End: c.End}
+}
+
+var (
+	// leadingMarker matches lines like "1:02:03 - Title" or "[02:03] Title"
+	leadingMarker = regexp.MustCompile(`^[\[(]?((?:\d{1,2}:)?\d{1,2}:\d{2})[\])]?\s*[-–—:|.)]*\s*(.*)$`)
+	// trailingMarker matches lines like "Title - 02:03"
+	trailingMarker = regexp.MustCompile(`^(.*?)\s*[-–—:|]*\s*[\[(]?((?:\d{1,2}:)?\d{1,2}:\d{2})[\])]?$`)
+)
+
+// ParseChapters reads the chapter markers of a video description. Like
+// YouTube, it only accepts ascending markers starting at 0:00. duration is
+// the length of the video, markers beyond it are ignored. It returns nil if
+// the description lists no chapters.
+func ParseChapters(description string, duration time.Duration) []Chapter {
+	var chapters []Chapter
+	sc := bufio.NewScanner(strings.NewReader(description))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		var stamp, title string
+		if m := leadingMarker.FindStringSubmatch(line); m != nil {
+			stamp, title = m[1], m[2]
+		} else if m := trailingMarker.FindStringSubmatch(line); m != nil {
+			stamp, title = m[2], m[1]
+		} else {
+			continue
+		}
+
+		start, ok := timestamp(stamp)
+		if !ok || (duration > 0 && start >= duration) {
+			continue
+		}
+		if len(chapters) == 0 && start != 0 {
+			continue
+		}
+		if n := len(chapters); n > 0 && start <= chapters[n-1].Start {
+			continue
+		}
+
+		title = strings.TrimSpace(title)
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", len(chapters)+1)
+		}
+		chapters = append(chapters, Chapter{Title: title, Start: start})
+	}
+
+	if len(chapters) < minChapters {
+		return nil
+	}
+
+	for i := range chapters {
+		if i+1 < len(chapters) {
+			chapters[i].End = chapters[i+1].Start
+		} else {
+			chapters[i].End = duration
+		}
+	}
+	return chapters
+}
+
+// timestamp parses a marker like 1:02:03 or 02:03.
+func timestamp(s string) (time.Duration, bool) {
+	var d time.Duration
+	for i, p := range strings.Split(s, ":") {
+		n, err := strconv.Atoi(p)
+		if err != nil || (i > 0 && n >= 60) {
+			return 0, false
+		}
+		d = d*60 + time.Duration(n)*time.Second
+	}
+	return d, true
+}
+
+// writeMetadata writes the chapters as ffmetadata file.
+func writeMetadata(w io.Writer, chapters []Chapter) error {
+	escape := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, ";FFMETADATA1")
+	for _, c := range chapters {
+		fmt.Fprintln(bw, "[CHAPTER]")
+		fmt.Fprintln(bw, "TIMEBASE=1/1000")
+		fmt.Fprintf(bw, "START=%d\n", c.Start/time.Millisecond)
+		if c.End > 0 {
+			fmt.Fprintf(bw, "END=%d\n", c.End/time.Millisecond)
+		}
+		fmt.Fprintf(bw, "title=%s\n", escape.Replace(c.Title))
+	}
+	return bw.Flush()
+}
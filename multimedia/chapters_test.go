@@ -0,0 +1,107 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseChapters(t *testing.T) {
+	const min = time.Minute
+	tests := []struct {
+		name        string
+		description string
+		duration    time.Duration
+		chapters    []Chapter
+	}{
+		{
+			name:        "leading markers",
+			description: "Intro text\n0:00 Intro\n[02:03] - Main part\n1:00:00 | Outro\nfollow us",
+			duration:    2 * time.Hour,
+			chapters: []Chapter{
+				{Title: "Intro", Start: 0, End: 2*min + 3*time.Second},
+				{Title: "Main part", Start: 2*min + 3*time.Second, End: time.Hour},
+				{Title: "Outro", Start: time.Hour, End: 2 * time.Hour},
+			},
+		},
+		{
+			name:        "trailing markers",
+			description: "Intro - 0:00\nQuestions (5:00)",
+			chapters: []Chapter{
+				{Title: "Intro", Start: 0, End: 5 * min},
+				{Title: "Questions", Start: 5 * min},
+			},
+		},
+		{
+			name:        "untitled chapters",
+			description: "0:00\n1:00 -",
+			duration:    2 * min,
+			chapters: []Chapter{
+				{Title: "Chapter 1", Start: 0, End: min},
+				{Title: "Chapter 2", Start: min, End: 2 * min},
+			},
+		},
+		{
+			name:        "not starting at zero",
+			description: "0:10 Intro\n1:00 Main",
+		},
+		{
+			name:        "descending and invalid markers",
+			description: "0:00 Intro\n3:00 Main\n2:00 Back\n4:75 Invalid\n5:00 End",
+			chapters: []Chapter{
+				{Title: "Intro", Start: 0, End: 3 * min},
+				{Title: "Main", Start: 3 * min, End: 5 * min},
+				{Title: "End", Start: 5 * min},
+			},
+		},
+		{
+			name:        "markers beyond the duration",
+			description: "0:00 Intro\n1:00 Main\n10:00 Bonus",
+			duration:    5 * min,
+			chapters: []Chapter{
+				{Title: "Intro", Start: 0, End: min},
+				{Title: "Main", Start: min, End: 5 * min},
+			},
+		},
+		{
+			name:        "single marker",
+			description: "0:00 Everything",
+		},
+		{
+			name: "no markers",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := ParseChapters(tt.description, tt.duration); !reflect.DeepEqual(got, tt.chapters) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.chapters)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		s  string
+		d  time.Duration
+		ok bool
+	}{
+		{s: "0:00", d: 0, ok: true},
+		{s: "02:03", d: 2*time.Minute + 3*time.Second, ok: true},
+		{s: "1:02:03", d: time.Hour + 2*time.Minute + 3*time.Second, ok: true},
+		{s: "1:60", ok: false},
+		{s: "1:60:00", ok: false},
+		{s: "a:00", ok: false},
+	}
+
+	for _, tt := range tests {
+		d, ok := timestamp(tt.s)
+		if d != tt.d || ok != tt.ok {
+			t.Errorf("timestamp(%q) = %v, %v, want %v, %v", tt.s, d, ok, tt.d, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyframeTolerance is the maximum distance of a keyframe to the start of a
+// clip which still allows to copy the streams.
+const keyframeTolerance = 50 * time.Millisecond
+
+// Range is a time range of a media file. A zero End extends the range to the
+// end of the file. The zero value covers the whole file.
+type Range struct {
+	Start time.Duration `json:"start,omitempty"`
+	End   time.Duration `json:"end,omitempty"`
+}
+
+// IsZero reports whether the range covers the whole file.
+func (r Range) IsZero() bool {
+	return r.Start == 0 && r.End == 0
+}
+
+// Validate checks that the range is not empty.
+func (r Range) Validate() error {
+	if r.Start < 0 || r.End < 0 {
+		return errors.New("start and end must not be negative")
+	}
+	if r.End > 0 && r.End <= r.Start {
+		return errors.New("end must be after start")
+	}
+	return nil
+}
+
+// Duration returns the length of the range, which is zero if it extends to
+// the end of the file.
+func (r Range) Duration() time.Duration {
+	if r.End == 0 {
+		return 0
+	}
+	return r.End - r.Start
+}
+
+// Key names files holding the range, e.g. 90s-150s. It is empty for the zero
+// range.
+func (r Range) Key() string {
+	if r.IsZero() {
+		return ""
+	}
+
+	key := func(d time.Duration) string {
+		if d%time.Second == 0 {
+			return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+		}
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	}
+
+	k := key(r.Start) + "-"
+	if r.End > 0 {
+		k += key(r.End)
+	}
+	return k
+}
+
+// String formats the range for humans, e.g. 1m30s-2m30s.
+func (r Range) String() string {
+	s := r.Start.String() + "-"
+	if r.End > 0 {
+		s += r.End.String()
+	}
+	return s
+}
+
+// clipCodecs lists the encoders used for clips of video containers which do
+// not start at a keyframe.
+var clipCodecs = map[string][]string{
+	"mp4":  {"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac"},
+	"webm": {"-c:v", "libvpx-vp9", "-c:a", "libopus"},
+}
+
+// muxer returns the ffmpeg muxer of files with the extension ext.
+func muxer(ext string) string {
+	if f, ok := tagFormats[ext]; ok {
+		return f.muxer
+	}
+	if f, ok := formats[ext]; ok {
+		return f.muxer
+	}
+	return ext
+}
+
+// keyframeAt reports whether the first video stream of the file at path has
+// a keyframe at t.
+func keyframeAt(ctx context.Context, path string, t time.Duration) (bool, error) {
+	if t == 0 {
+		return true, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	// ffprobe seeks to the keyframe preceding the interval start
+	interval := fmt.Sprintf("%f%%+%f", t.Seconds(), keyframeTolerance.Seconds())
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-skip_frame", "nokey",
+		"-read_intervals", interval, "-show_entries", "frame=best_effort_timestamp_time", "-of", "csv=p=0", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("ffprobe failed to read keyframes of %s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	for _, line := range strings.Fields(stdout.String()) {
+		sec, err := strconv.ParseFloat(strings.TrimSuffix(line, ","), 64)
+		if err != nil {
+			continue
+		}
+		if math.Abs(sec-t.Seconds()) <= keyframeTolerance.Seconds() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
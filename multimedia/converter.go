@@ -7,6 +7,9 @@ import (
 
 // Converter converts and merges multimedia types
 type Converter interface {
-	Convert(ctx context.Context, src io.Reader, dst io.Writer) error
-	Merge(ctx context.Context, video, audio io.Reader, dst io.Writer) error
+	Convert(ctx context.Context, src io.Reader, dst io.Writer, spec Spec) error
+	Merge(ctx context.Context, video, audio io.Reader, dst io.Writer, subs ...Subtitle) error
+	Remux(ctx context.Context, src io.Reader, dst io.Writer) error
+	Tag(ctx context.Context, src io.Reader, dst io.Writer, ext string, tags Tags) error
+	Clip(ctx context.Context, src io.Reader, dst io.Writer, ext string, r Range) error
 }
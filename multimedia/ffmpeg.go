@@ -2,11 +2,13 @@ package multimedia
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
 )
 
 type ffmpegConverter struct {
@@ -16,19 +18,76 @@ func NewFFMPEG() Converter {
 	return ffmpegConverter{}
 }
 
-func (c ffmpegConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer) error {
-	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", "-", "-f", "mp3", "-")
+// Convert encodes the audio stream of src as described by spec. Formats whose
+// muxer needs to seek are written to a temporary file first. Filters which
+// need to analyze the input first read it from a temporary file.
+func (c ffmpegConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, spec Spec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
 
-	cmd.Stdout = dst
-	cmd.Stdin = src
-	err := cmd.Run()
+	input := []string{"-i", "-"}
+	var a analysis
+	if spec.Filter.twoPass() {
+		sf, err := ioutil.TempFile("", "ytdl-unfiltered")
+		if err != nil {
+			return fmt.Errorf("failed to create tmp source file")
+		}
+		defer os.Remove(sf.Name())
+
+		_, err = io.Copy(sf, src)
+		sf.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy source input to temp file: %v", err)
+		}
+
+		a, err = analyze(ctx, sf.Name(), spec.Filter)
+		if err != nil {
+			return err
+		}
+		input, src = []string{"-i", sf.Name()}, nil
+	}
+	if chain := spec.Filter.chain(a, spec.SampleRate); chain != "" {
+		input = append(input, "-af", chain)
+	}
+
+	if !spec.format().seekable {
+		cmd := command(ctx, append(append(input, spec.args()...), "-")...)
+
+		cmd.Stdout = dst
+		cmd.Stdin = src
+		err := run(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("ffmpeg failed to convert video: %v", err)
+		}
+		return nil
+	}
+
+	of, err := ioutil.TempFile("", "ytdl-converted")
 	if err != nil {
+		return fmt.Errorf("failed to create tmp output file")
+	}
+	defer os.Remove(of.Name())
+	defer of.Close()
+
+	cmd := command(ctx, append(append(input, spec.args()...), "-movflags", "+faststart", "-y", of.Name())...)
+	cmd.Stdin = src
+	if err := run(ctx, cmd); err != nil {
 		return fmt.Errorf("ffmpeg failed to convert video: %v", err)
 	}
+
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed seeking converted file: %v", err)
+	}
+	if _, err := io.Copy(dst, of); err != nil {
+		return fmt.Errorf("failed writing converted file to dst: %v", err)
+	}
 	return nil
 }
 
-func (c ffmpegConverter) Merge(ctx context.Context, video, audio io.Reader, dst io.Writer) error {
+// Merge combines the video and audio stream into an mp4 file. Subtitles are
+// added as separate streams, at most one can be rendered into the video.
+func (c ffmpegConverter) Merge(ctx context.Context, video, audio io.Reader, dst io.Writer, subs ...Subtitle) error {
 	vf, err := ioutil.TempFile("", "ytdl-video")
 	if err != nil {
 		return fmt.Errorf("failed to create tmp video file")
@@ -57,9 +116,47 @@ func (c ffmpegConverter) Merge(ctx context.Context, video, audio io.Reader, dst
 	}
 	af.Close()
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", vf.Name(), "-i", af.Name(), "-f", "mp4", "-y", of.Name())
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	args := []string{"-i", vf.Name(), "-i", af.Name()}
+	maps := []string{"-map", "0:v:0", "-map", "1:a:0"}
+	var streams []string
+	burned := false
+	for _, sub := range subs {
+		sf, err := ioutil.TempFile("", "ytdl-subtitle-*.vtt")
+		if err != nil {
+			return fmt.Errorf("failed to create tmp subtitle file")
+		}
+		defer os.Remove(sf.Name())
+
+		_, err = sf.Write(sub.Data)
+		sf.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to temp file: %v", err)
+		}
+
+		if sub.Burn {
+			if burned {
+				return errors.New("only one subtitle can be burned in")
+			}
+			burned = true
+			maps = append(maps, "-vf", "subtitles="+sf.Name())
+			continue
+		}
+
+		i := len(streams)
+		maps = append(maps, "-map", strconv.Itoa(len(args)/2))
+		streams = append(streams, "-metadata:s:s:"+strconv.Itoa(i), "language="+sub.Language)
+		if sub.Title != "" {
+			streams = append(streams, "-metadata:s:s:"+strconv.Itoa(i), "title="+sub.Title)
+		}
+		args = append(args, "-i", sf.Name())
+	}
+	if len(streams) > 0 {
+		streams = append(streams, "-c:s", "mov_text")
+	}
+
+	args = append(append(append(args, maps...), streams...), "-f", "mp4", "-y", of.Name())
+	cmd := command(ctx, args...)
+	if err := run(ctx, cmd); err != nil {
 		return fmt.Errorf("failed to merge audio and video: %v", err)
 	}
 
@@ -73,3 +170,251 @@ func (c ffmpegConverter) Merge(ctx context.Context, video, audio io.Reader, dst
 
 	return nil
 }
+
+// Remux copies the video and audio stream of src into an mp4 container. Audio
+// streams which mp4 can not hold are converted to aac.
+func (c ffmpegConverter) Remux(ctx context.Context, src io.Reader, dst io.Writer) error {
+	sf, err := ioutil.TempFile("", "ytdl-source")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp source file")
+	}
+	defer os.Remove(sf.Name())
+
+	of, err := ioutil.TempFile("", "ytdl-remuxed")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp remux file")
+	}
+	defer os.Remove(of.Name())
+	defer of.Close()
+
+	if _, err := io.Copy(sf, src); err != nil {
+		return fmt.Errorf("failed to copy source input to temp file: %v", err)
+	}
+	sf.Close()
+
+	cmd := command(ctx, "-i", sf.Name(), "-map", "0:v:0?", "-map", "0:a:0?", "-c:v", "copy", "-c:a", "aac", "-f", "mp4", "-y", of.Name())
+	if err := run(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to remux source: %v", err)
+	}
+
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed seeking remuxed file: %v", err)
+	}
+	if _, err := io.Copy(dst, of); err != nil {
+		return fmt.Errorf("failed writing remuxed file to dst: %v", err)
+	}
+
+	return nil
+}
+
+// Tag copies the streams of src into a file with the extension ext and
+// writes tags into it. Cover art is added as attached picture, chapters
+// replace the ones of src.
+func (c ffmpegConverter) Tag(ctx context.Context, src io.Reader, dst io.Writer, ext string, tags Tags) error {
+	f, ok := tagFormats[ext]
+	if !ok {
+		return fmt.Errorf("tags are not supported for %s files", ext)
+	}
+
+	sf, err := ioutil.TempFile("", "ytdl-untagged")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp source file")
+	}
+	defer os.Remove(sf.Name())
+
+	of, err := ioutil.TempFile("", "ytdl-tagged")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp tag file")
+	}
+	defer os.Remove(of.Name())
+	defer of.Close()
+
+	if _, err := io.Copy(sf, src); err != nil {
+		return fmt.Errorf("failed to copy source input to temp file: %v", err)
+	}
+	sf.Close()
+
+	args := []string{"-i", sf.Name()}
+	maps := []string{"-map", "0"}
+	if f.cover && len(tags.Cover) > 0 {
+		cf, err := ioutil.TempFile("", "ytdl-cover")
+		if err != nil {
+			return fmt.Errorf("failed to create tmp cover file")
+		}
+		defer os.Remove(cf.Name())
+
+		_, err = cf.Write(tags.Cover)
+		cf.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write cover to temp file: %v", err)
+		}
+
+		// a previous cover is replaced, it is the only video stream of audio
+		// files and follows the video stream of mp4 files
+		maps = []string{"-map", "0:a?", "-map", "1", "-disposition:v:0", "attached_pic"}
+		if ext == "mp4" {
+			maps = []string{"-map", "0:v:0", "-map", "0:a?", "-map", "0:s?", "-map", "1", "-disposition:v:1", "attached_pic"}
+		}
+		args = append(args, "-i", cf.Name())
+	}
+
+	if len(tags.Chapters) > 0 {
+		mf, err := ioutil.TempFile("", "ytdl-chapters")
+		if err != nil {
+			return fmt.Errorf("failed to create tmp chapter file")
+		}
+		defer os.Remove(mf.Name())
+
+		err = writeMetadata(mf, tags.Chapters)
+		mf.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write chapters to temp file: %v", err)
+		}
+
+		// the chapter file is the last input, each input takes two arguments
+		maps = append(maps, "-map_chapters", strconv.Itoa(len(args)/2))
+		args = append(args, "-f", "ffmetadata", "-i", mf.Name())
+	}
+
+	args = append(args, maps...)
+	args = append(args, "-c", "copy")
+	for _, kv := range [][2]string{
+		{"title", tags.Title},
+		{"artist", tags.Artist},
+		{"album", tags.Album},
+		{"date", tags.Date},
+		{"comment", tags.Comment},
+		{"genre", tags.Genre},
+		{"track", tags.Track},
+	} {
+		if kv[1] != "" {
+			args = append(args, "-metadata", kv[0]+"="+kv[1])
+		}
+	}
+	if ext == "mp3" {
+		args = append(args, "-id3v2_version", "3")
+	}
+	args = append(args, "-f", f.muxer, "-y", of.Name())
+
+	if err := run(ctx, command(ctx, args...)); err != nil {
+		return fmt.Errorf("failed to write tags: %v", err)
+	}
+
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed seeking tagged file: %v", err)
+	}
+	if _, err := io.Copy(dst, of); err != nil {
+		return fmt.Errorf("failed writing tagged file to dst: %v", err)
+	}
+	return nil
+}
+
+// Clip cuts the range r out of src, a file with the extension ext. Streams
+// are copied if the range starts at a keyframe or src holds no video, and
+// encoded again otherwise.
+func (c ffmpegConverter) Clip(ctx context.Context, src io.Reader, dst io.Writer, ext string, r Range) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	sf, err := ioutil.TempFile("", "ytdl-unclipped")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp source file")
+	}
+	defer os.Remove(sf.Name())
+
+	of, err := ioutil.TempFile("", "ytdl-clipped")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp clip file")
+	}
+	defer os.Remove(of.Name())
+	defer of.Close()
+
+	if _, err := io.Copy(sf, src); err != nil {
+		return fmt.Errorf("failed to copy source input to temp file: %v", err)
+	}
+	sf.Close()
+
+	md, err := Probe(ctx, sf.Name())
+	if err != nil {
+		return err
+	}
+
+	streamCopy := true
+	if md.HasVideo {
+		streamCopy, err = keyframeAt(ctx, sf.Name(), r.Start)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"-ss", strconv.FormatFloat(r.Start.Seconds(), 'f', 3, 64), "-i", sf.Name()}
+	if d := r.Duration(); d > 0 {
+		args = append(args, "-t", strconv.FormatFloat(d.Seconds(), 'f', 3, 64))
+	}
+
+	codecs, ok := clipCodecs[ext]
+	switch {
+	case streamCopy:
+		args = append(args, "-map", "0", "-c", "copy", "-avoid_negative_ts", "make_zero")
+	case ok:
+		args = append(append(args, "-map", "0:v:0", "-map", "0:a?"), codecs...)
+	default:
+		return fmt.Errorf("clips of %s files have to start at a keyframe", ext)
+	}
+
+	m := muxer(ext)
+	if m == "mp4" || m == "ipod" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, "-f", m, "-y", of.Name())
+
+	if err := run(ctx, command(ctx, args...)); err != nil {
+		return fmt.Errorf("failed to clip source: %v", err)
+	}
+
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed seeking clipped file: %v", err)
+	}
+	if _, err := io.Copy(dst, of); err != nil {
+		return fmt.Errorf("failed writing clipped file to dst: %v", err)
+	}
+	return nil
+}
+
+// command returns an ffmpeg command which writes its progress to stderr.
+func command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ffmpeg", append([]string{"-nostats", "-progress", "pipe:2"}, args...)...)
+}
+
+// run executes cmd and reports its progress to the progress function of ctx.
+func run(ctx context.Context, cmd *exec.Cmd) error {
+	return runLog(ctx, cmd, nil)
+}
+
+// runLog is like run, but additionally writes the output of ffmpeg to log if
+// it is not nil.
+func runLog(ctx context.Context, cmd *exec.Cmd, log io.Writer) error {
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var r io.Reader = stderr
+	if log != nil {
+		r = io.TeeReader(stderr, log)
+	}
+	last := parseProgress(r, progressFunc(ctx))
+
+	if err := cmd.Wait(); err != nil {
+		if last != "" {
+			return fmt.Errorf("%v: %s", err, last)
+		}
+		return err
+	}
+	return nil
+}
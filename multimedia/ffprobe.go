@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata describes the container of a media file.
+type Metadata struct {
+	Duration time.Duration
+	Title    string
+	Artist   string
+	Album    string
+	Date     string
+	Comment  string
+	HasVideo bool
+	HasAudio bool
+}
+
+type probe struct {
+	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// Probe reads the container metadata of the file at path using ffprobe.
+func Probe(ctx context.Context, path string) (Metadata, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Metadata{}, fmt.Errorf("ffprobe failed to read %s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var p probe
+	if err := json.Unmarshal(stdout.Bytes(), &p); err != nil {
+		return Metadata{}, fmt.Errorf("failed to decode ffprobe output: %v", err)
+	}
+
+	// tag names differ in case between containers
+	tags := make(map[string]string)
+	for k, v := range p.Format.Tags {
+		tags[strings.ToLower(k)] = v
+	}
+
+	md := Metadata{
+		Title:   tags["title"],
+		Artist:  tags["artist"],
+		Album:   tags["album"],
+		Date:    tags["date"],
+		Comment: tags["comment"],
+	}
+	if sec, err := strconv.ParseFloat(p.Format.Duration, 64); err == nil {
+		md.Duration = time.Duration(sec * float64(time.Second))
+	}
+	for _, s := range p.Streams {
+		switch s.CodecType {
+		case "video":
+			// cover art is stored as a video stream
+			if s.Disposition.AttachedPic == 0 {
+				md.HasVideo = true
+			}
+		case "audio":
+			md.HasAudio = true
+		}
+	}
+
+	return md, nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// silenceThreshold is the volume below which audio counts as silence.
+	silenceThreshold = "-50dB"
+	// minSilence is the minimum length of silence which is trimmed.
+	minSilence = time.Second
+	// loudnormRate is the sample rate normalized audio is resampled to, as
+	// loudnorm upsamples to 192 kHz.
+	loudnormRate = 48000
+)
+
+// Filter describes the processing of audio before it is encoded. The zero
+// value leaves audio untouched.
+type Filter struct {
+	// Loudness is the integrated loudness target in LUFS, e.g. -16. Audio is
+	// normalized according to EBU R128 in two passes if it is set.
+	Loudness int `json:"loudness,omitempty"`
+	// TrimSilence removes silence at the start and end.
+	TrimSilence bool `json:"trim_silence,omitempty"`
+	// Tempo speeds audio up or slows it down without changing its pitch,
+	// e.g. 1.5.
+	Tempo float64 `json:"tempo,omitempty"`
+	// HighPass removes frequencies below the cutoff in Hz, e.g. 80.
+	HighPass int `json:"high_pass,omitempty"`
+}
+
+// IsZero reports whether the filter leaves audio untouched.
+func (f Filter) IsZero() bool {
+	return f == Filter{}
+}
+
+// Validate checks that the filter values are in the range ffmpeg supports.
+func (f Filter) Validate() error {
+	if f.Loudness != 0 && (f.Loudness < -70 || f.Loudness > -5) {
+		return errors.New("loudness must be between -70 and -5 LUFS")
+	}
+	if f.Tempo != 0 && (f.Tempo < 0.5 || f.Tempo > 4) {
+		return errors.New("tempo must be between 0.5 and 4")
+	}
+	// the key only distinguishes tempos by two decimals
+	if t := f.Tempo * 100; math.Abs(t-math.Round(t)) > 1e-6 {
+		return errors.New("tempo must not have more than two decimals")
+	}
+	if f.HighPass < 0 || f.HighPass > 20000 {
+		return errors.New("high pass cutoff must be between 1 and 20000 Hz")
+	}
+	return nil
+}
+
+// Key identifies the filter, e.g. hp80-trim-tempo150-lufs16. It is empty for
+// the zero filter.
+func (f Filter) Key() string {
+	var parts []string
+	if f.HighPass > 0 {
+		parts = append(parts, "hp"+strconv.Itoa(f.HighPass))
+	}
+	if f.TrimSilence {
+		parts = append(parts, "trim")
+	}
+	if f.Tempo > 0 {
+		parts = append(parts, "tempo"+strconv.Itoa(int(math.Round(f.Tempo*100))))
+	}
+	if f.Loudness != 0 {
+		parts = append(parts, "lufs"+strconv.Itoa(-f.Loudness))
+	}
+	return strings.Join(parts, "-")
+}
+
+// twoPass reports whether the input has to be analyzed before filtering.
+func (f Filter) twoPass() bool {
+	return f.Loudness != 0 || f.TrimSilence
+}
+
+// analysis holds the results of the first pass over the input.
+type analysis struct {
+	loudness loudness
+	// start and end of the audio without silence, a zero end keeps the end
+	start, end time.Duration
+}
+
+// loudness is the measurement printed by the loudnorm filter.
+type loudness struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// chain returns the ffmpeg filter graph of f. The input is trimmed and
+// normalized with the results of a.
+func (f Filter) chain(a analysis, sampleRate int) string {
+	var filters []string
+	if f.HighPass > 0 {
+		filters = append(filters, fmt.Sprintf("highpass=f=%d", f.HighPass))
+	}
+	if f.TrimSilence && (a.start > 0 || a.end > 0) {
+		trim := fmt.Sprintf("atrim=start=%.3f", a.start.Seconds())
+		if a.end > 0 {
+			trim += fmt.Sprintf(":end=%.3f", a.end.Seconds())
+		}
+		filters = append(filters, trim, "asetpts=PTS-STARTPTS")
+	}
+	if f.Tempo > 0 {
+		// a single atempo filter is limited to a factor of two
+		t := f.Tempo
+		for ; t > 2; t /= 2 {
+			filters = append(filters, "atempo=2")
+		}
+		filters = append(filters, "atempo="+strconv.FormatFloat(t, 'f', -1, 64))
+	}
+	if f.Loudness != 0 {
+		l := a.loudness
+		filters = append(filters, fmt.Sprintf("loudnorm=I=%d:TP=-1.5:LRA=11:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			f.Loudness, l.InputI, l.InputTP, l.InputLRA, l.InputThresh, l.TargetOffset))
+		if sampleRate == 0 {
+			filters = append(filters, fmt.Sprintf("aresample=%d", loudnormRate))
+		}
+	}
+	return strings.Join(filters, ",")
+}
+
+// analyze measures the loudness and detects the silence at the start and end
+// of the file at path as needed by f.
+func analyze(ctx context.Context, path string, f Filter) (analysis, error) {
+	var a analysis
+
+	var filters []string
+	if f.HighPass > 0 {
+		filters = append(filters, fmt.Sprintf("highpass=f=%d", f.HighPass))
+	}
+	if f.TrimSilence {
+		filters = append(filters, fmt.Sprintf("silencedetect=noise=%s:d=%.3f", silenceThreshold, minSilence.Seconds()))
+	}
+	if f.Loudness != 0 {
+		filters = append(filters, fmt.Sprintf("loudnorm=I=%d:TP=-1.5:LRA=11:print_format=json", f.Loudness))
+	}
+
+	var out bytes.Buffer
+	cmd := command(ctx, "-i", path, "-vn", "-af", strings.Join(filters, ","), "-f", "null", "-")
+	if err := runLog(ctx, cmd, &out); err != nil {
+		return a, fmt.Errorf("ffmpeg failed to analyze audio: %v", err)
+	}
+
+	if f.Loudness != 0 {
+		// the measurement is the last JSON object of the output
+		s := out.String()
+		start, end := strings.LastIndex(s, "{"), strings.LastIndex(s, "}")
+		if start < 0 || end < start {
+			return a, errors.New("ffmpeg did not report the loudness")
+		}
+		if err := json.Unmarshal([]byte(s[start:end+1]), &a.loudness); err != nil {
+			return a, fmt.Errorf("failed to decode loudness: %v", err)
+		}
+	}
+
+	if f.TrimSilence {
+		md, err := Probe(ctx, path)
+		if err != nil {
+			return a, err
+		}
+		a.start, a.end = silence(out.String(), md.Duration)
+	}
+
+	return a, nil
+}
+
+var silenceRegexp = regexp.MustCompile(`silence_(start|end): (-?[0-9.]+)`)
+
+// silence returns the range of audio without leading and trailing silence
+// from the output of the silencedetect filter. A zero end keeps the end of
+// the input.
+func silence(out string, duration time.Duration) (start, end time.Duration) {
+	// a silence reaching the end of the input may lack its end
+	type period struct{ start, end time.Duration }
+	var periods []period
+	for _, m := range silenceRegexp.FindAllStringSubmatch(out, -1) {
+		sec, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		t := time.Duration(sec * float64(time.Second))
+		switch {
+		case m[1] == "start":
+			periods = append(periods, period{start: t, end: -1})
+		case len(periods) > 0:
+			periods[len(periods)-1].end = t
+		}
+	}
+	if len(periods) == 0 {
+		return 0, 0
+	}
+
+	const tolerance = 100 * time.Millisecond
+	if first := periods[0]; first.start <= tolerance && first.end > 0 {
+		start = first.end
+	}
+	last := periods[len(periods)-1]
+	if last.end < 0 || (duration > 0 && last.end >= duration-tolerance) {
+		if last.start > start {
+			end = last.start
+		}
+	}
+	return start, end
+}
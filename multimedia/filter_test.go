@@ -0,0 +1,33 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import "testing"
+
+func TestFilterTempo(t *testing.T) {
+	tests := []struct {
+		tempo float64
+		key   string
+		valid bool
+	}{
+		{tempo: 1.5, key: "tempo150", valid: true},
+		{tempo: 1.25, key: "tempo125", valid: true},
+		{tempo: 0.51, key: "tempo51", valid: true},
+		{tempo: 1.255, valid: false},
+		{tempo: 1.001, valid: false},
+		{tempo: 0.4, valid: false},
+	}
+
+	for _, tt := range tests {
+		f := Filter{Tempo: tt.tempo}
+		if err := f.Validate(); (err == nil) != tt.valid {
+			t.Errorf("tempo %v: got error %v, want valid %v", tt.tempo, err, tt.valid)
+		}
+		if tt.valid && f.Key() != tt.key {
+			t.Errorf("tempo %v: got key %s, want %s", tt.tempo, f.Key(), tt.key)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type progressKey struct{}
+
+// WithProgress returns a context which makes converters report their
+// progress to fn. current and total are milliseconds of media time, total is
+// zero if the duration of the input is unknown.
+func WithProgress(ctx context.Context, fn func(current, total int64)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFunc(ctx context.Context) func(current, total int64) {
+	fn, _ := ctx.Value(progressKey{}).(func(current, total int64))
+	return fn
+}
+
+// parseProgress reads the output of ffmpeg started with -progress and reports
+// it to fn, which may be nil. It returns the last line which was not part of
+// the progress output to describe failures.
+func parseProgress(r io.Reader, fn func(current, total int64)) string {
+	var total, current int64
+	var last string
+
+	report := func() {
+		if fn != nil {
+			fn(current, total)
+		}
+	}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		if strings.HasPrefix(line, "Duration:") {
+			field := strings.TrimSpace(strings.SplitN(strings.TrimPrefix(line, "Duration:"), ",", 2)[0])
+			if d, ok := parseTimestamp(field); ok && d > total {
+				total = d
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			if line != "" {
+				last = line
+			}
+			continue
+		}
+
+		switch kv[0] {
+		case "out_time_ms", "out_time_us":
+			// both keys are reported in microseconds
+			if us, err := strconv.ParseInt(kv[1], 10, 64); err == nil && us >= 0 {
+				current = us / 1000
+			}
+		case "progress":
+			if kv[1] == "end" && total > 0 {
+				current = total
+			}
+			report()
+		case "frame", "fps", "bitrate", "total_size", "out_time", "dup_frames", "drop_frames", "speed":
+		default:
+			if !strings.HasPrefix(kv[0], "stream_") {
+				last = line
+			}
+		}
+	}
+
+	return last
+}
+
+// parseTimestamp parses timestamps of the form HH:MM:SS.ms into milliseconds.
+func parseTimestamp(s string) (int64, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	sec, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second))
+	return int64(d / time.Millisecond), true
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Spec describes the encoding of an audio output. The zero value encodes mp3
+// with the defaults of ffmpeg.
+type Spec struct {
+	// Format is one of mp3, opus, m4a, ogg, flac or wav.
+	Format string `json:"format,omitempty"`
+	// Bitrate is the constant bitrate in kbit/s.
+	Bitrate int `json:"bitrate,omitempty"`
+	// Quality selects variable bitrate encoding from 1 (lowest) to 10
+	// (highest) quality. It takes precedence over Bitrate.
+	Quality    int `json:"quality,omitempty"`
+	SampleRate int `json:"sample_rate,omitempty"` // in Hz
+	Channels   int `json:"channels,omitempty"`    // 1 is mono, 2 stereo
+	// Filter processes the audio before it is encoded.
+	Filter Filter `json:"filter"`
+}
+
+type format struct {
+	muxer     string
+	codec     string
+	ext       string
+	mimeType  string
+	lossless  bool
+	seekable  bool // the muxer needs a seekable output
+	vbr       func(quality int) []string
+	rateLimit int // maximum bitrate in kbit/s
+}
+
+var formats = map[string]format{
+	"mp3": {
+		muxer: "mp3", codec: "libmp3lame", ext: "mp3", mimeType: "audio/mpeg", rateLimit: 320,
+		// lame qualities range from 9 (lowest) to 0 (highest)
+		vbr: func(q int) []string { return []string{"-q:a", strconv.Itoa(10 - q)} },
+	},
+	"opus": {
+		muxer: "opus", codec: "libopus", ext: "opus", mimeType: "audio/ogg", rateLimit: 512,
+		// opus always encodes with variable bitrate, the quality selects the target
+		vbr: func(q int) []string { return []string{"-vbr", "on", "-b:a", strconv.Itoa(16*q) + "k"} },
+	},
+	"m4a": {
+		muxer: "ipod", codec: "aac", ext: "m4a", mimeType: "audio/mp4", seekable: true, rateLimit: 512,
+		vbr: func(q int) []string { return []string{"-q:a", strconv.FormatFloat(float64(q)/5, 'f', 1, 64)} },
+	},
+	"ogg": {
+		muxer: "ogg", codec: "libvorbis", ext: "ogg", mimeType: "audio/ogg", rateLimit: 500,
+		vbr: func(q int) []string { return []string{"-q:a", strconv.Itoa(q)} },
+	},
+	"flac": {muxer: "flac", codec: "flac", ext: "flac", mimeType: "audio/flac", lossless: true},
+	"wav":  {muxer: "wav", codec: "pcm_s16le", ext: "wav", mimeType: "audio/wav", lossless: true},
+}
+
+func (s Spec) format() format {
+	if s.Format == "" {
+		return formats["mp3"]
+	}
+	return formats[s.Format]
+}
+
+// Validate checks that the spec describes a supported encoding.
+func (s Spec) Validate() error {
+	if _, ok := formats[s.Format]; s.Format != "" && !ok {
+		return fmt.Errorf("unsupported audio format: %q", s.Format)
+	}
+	if f := s.format(); s.Bitrate < 0 || (!f.lossless && s.Bitrate > f.rateLimit) {
+		return fmt.Errorf("bitrate must be between 1 and %d kbit/s", f.rateLimit)
+	}
+	if s.Quality < 0 || s.Quality > 10 {
+		return errors.New("quality must be between 1 and 10")
+	}
+	if s.SampleRate < 0 || s.SampleRate > 192000 {
+		return errors.New("invalid sample rate")
+	}
+	if s.Channels < 0 || s.Channels > 2 {
+		return errors.New("channels must be 1 or 2")
+	}
+	return s.Filter.Validate()
+}
+
+// IsZero reports whether the spec selects the default encoding.
+func (s Spec) IsZero() bool {
+	return s == Spec{} || s == Spec{Format: "mp3"}
+}
+
+// Extension returns the file extension of the output.
+func (s Spec) Extension() string {
+	return s.format().ext
+}
+
+// MIMEType returns the content type of the output.
+func (s Spec) MIMEType() string {
+	return s.format().mimeType
+}
+
+// Key identifies the encoding, outputs with equal keys are interchangeable.
+// It is empty for the default encoding.
+func (s Spec) Key() string {
+	if s.IsZero() {
+		return ""
+	}
+
+	f := s.format()
+	parts := []string{f.ext}
+	switch {
+	case f.lossless:
+	case s.Quality > 0:
+		parts = append(parts, "q"+strconv.Itoa(s.Quality))
+	case s.Bitrate > 0:
+		parts = append(parts, strconv.Itoa(s.Bitrate)+"k")
+	}
+	if s.SampleRate > 0 {
+		parts = append(parts, strconv.Itoa(s.SampleRate)+"hz")
+	}
+	switch s.Channels {
+	case 1:
+		parts = append(parts, "mono")
+	case 2:
+		parts = append(parts, "stereo")
+	}
+	if k := s.Filter.Key(); k != "" {
+		parts = append(parts, k)
+	}
+	return strings.Join(parts, "-")
+}
+
+// args returns the ffmpeg output options of the spec.
+func (s Spec) args() []string {
+	f := s.format()
+	args := []string{"-vn", "-c:a", f.codec}
+	switch {
+	case f.lossless:
+	case s.Quality > 0:
+		args = append(args, f.vbr(s.Quality)...)
+	case s.Bitrate > 0:
+		args = append(args, "-b:a", strconv.Itoa(s.Bitrate)+"k")
+	}
+	if s.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(s.SampleRate))
+	}
+	if s.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(s.Channels))
+	}
+	return append(args, "-f", f.muxer)
+}
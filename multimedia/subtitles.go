@@ -0,0 +1,85 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Subtitle is a subtitle track in WebVTT format.
+type Subtitle struct {
+	Language string
+	Title    string
+	Data     []byte
+	// Burn renders the subtitle into the video instead of adding it as
+	// separate stream.
+	Burn bool
+}
+
+var (
+	// cueTiming matches the timing line of a WebVTT cue
+	cueTiming = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3}) --> ((?:\d+:)?\d{2}:\d{2}\.\d{3})`)
+	// cueTag matches the markup within WebVTT cues, e.g. <c> or <00:00:01.000>
+	cueTag = regexp.MustCompile(`<[^>]*>`)
+)
+
+// WriteSRT converts the WebVTT subtitle vtt to SubRip. Markup and cue
+// settings are dropped.
+func WriteSRT(w io.Writer, vtt []byte) error {
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(bytes.NewReader(vtt))
+
+	n := 0
+	var text []string
+	var timing string
+	flush := func() {
+		if timing != "" && len(text) > 0 {
+			n++
+			fmt.Fprintf(bw, "%d\n%s\n%s\n\n", n, timing, strings.Join(text, "\n"))
+		}
+		timing, text = "", nil
+	}
+
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if m := cueTiming.FindStringSubmatch(line); m != nil {
+			flush()
+			timing = srtTime(m[1]) + " --> " + srtTime(m[2])
+			continue
+		}
+		if line == "" {
+			flush()
+			continue
+		}
+		// text outside of cues belongs to the header, notes or styles
+		if timing == "" {
+			continue
+		}
+		if t := strings.TrimSpace(cueTag.ReplaceAllString(line, "")); t != "" {
+			text = append(text, t)
+		}
+	}
+	flush()
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// srtTime converts a WebVTT timestamp to SubRip, which always includes hours
+// and separates milliseconds by comma.
+func srtTime(ts string) string {
+	if strings.Count(ts, ":") == 1 {
+		ts = "00:" + ts
+	}
+	return strings.Replace(ts, ".", ",", 1)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package multimedia
+
+import (
+	"context"
+	"io"
+)
+
+// Tags is the metadata written into media files. Empty fields are not
+// written.
+type Tags struct {
+	Title   string
+	Artist  string
+	Album   string
+	Date    string
+	Comment string
+	Genre   string
+	// Track is the position within the album, e.g. 3/12.
+	Track string
+	// Chapters are embedded as ID3 CHAP frames or MP4 chapters.
+	Chapters []Chapter
+	// Cover is an image embedded as cover art where the container supports
+	// it.
+	Cover []byte
+}
+
+// tagFormats maps the extensions of taggable files to their muxer and whether
+// cover art can be embedded.
+var tagFormats = map[string]struct {
+	muxer string
+	cover bool
+}{
+	"mp3":  {"mp3", true},
+	"m4a":  {"ipod", true},
+	"mp4":  {"mp4", true},
+	"flac": {"flac", true},
+	"ogg":  {"ogg", false},
+	"opus": {"opus", false},
+}
+
+// CanTag reports whether tags can be written into files with the extension
+// ext.
+func CanTag(ext string) bool {
+	_, ok := tagFormats[ext]
+	return ok
+}
+
+// Tagged writes the output of fn to dst with tags added. ext is the extension
+// of the output, which is written as it is if it can not carry tags.
+func Tagged(ctx context.Context, c Converter, dst io.Writer, ext string, tags Tags, fn func(w io.Writer) error) error {
+	if !CanTag(ext) {
+		return fn(dst)
+	}
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := fn(pw)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+
+	err := c.Tag(ctx, pr, dst, ext, tags)
+	pr.CloseWithError(err)
+
+	// an error of fn makes Tag fail as well, but is more descriptive
+	if ferr := <-errc; ferr != nil {
+		return ferr
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package progress
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Units used to describe the progress of a stage.
+const (
+	Bytes        = "bytes"
+	Milliseconds = "ms"
+)
+
+// Event describes the progress of a single stage of a download.
+type Event struct {
+	ID      string  `json:"id"`
+	Stage   string  `json:"stage"`
+	Unit    string  `json:"unit,omitempty"`
+	Current int64   `json:"current"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	Done    bool    `json:"done"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Broker distributes progress events to subscribers of a video id.
+type Broker struct {
+	m      sync.Mutex
+	subs   map[string]map[chan Event]struct{}
+	last   map[string]Event
+	closed bool
+}
+
+// NewBroker returns an empty broker.
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[string]map[chan Event]struct{}),
+		last: make(map[string]Event),
+	}
+}
+
+// Publish sends the event to all subscribers of its id. Slow subscribers
+// miss events instead of blocking the publisher.
+func (b *Broker) Publish(e Event) {
+	if e.Total > 0 {
+		e.Percent = float64(e.Current) / float64(e.Total) * 100
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if e.Done {
+		delete(b.last, e.ID)
+	} else {
+		b.last[e.ID] = e
+	}
+
+	for ch := range b.subs[e.ID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all events for id, starting with the
+// most recent one. The returned function cancels the subscription.
+func (b *Broker) Subscribe(id string) (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[chan Event]struct{})
+	}
+	b.subs[id][ch] = struct{}{}
+	if e, ok := b.last[id]; ok {
+		ch <- e
+	}
+
+	return ch, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+
+		if _, ok := b.subs[id][ch]; !ok {
+			return
+		}
+		delete(b.subs[id], ch)
+		if len(b.subs[id]) == 0 {
+			delete(b.subs, id)
+		}
+	}
+}
+
+// Close ends all subscriptions by closing their channels.
+func (b *Broker) Close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	for id, subs := range b.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(b.subs, id)
+	}
+}
+
+// Stage returns a function reporting progress of a named stage for id. It is
+// safe to call on a nil broker.
+func (b *Broker) Stage(id, stage, unit string) func(current, total int64) {
+	return func(current, total int64) {
+		if b == nil {
+			return
+		}
+		b.Publish(Event{ID: id, Stage: stage, Unit: unit, Current: current, Total: total})
+	}
+}
+
+// Finish reports the end of all stages for id along with an optional error.
+// It is safe to call on a nil broker.
+func (b *Broker) Finish(id string, err error) {
+	if b == nil {
+		return
+	}
+
+	e := Event{ID: id, Stage: "finished", Done: true}
+	if err != nil {
+		e.Stage = "failed"
+		e.Error = err.Error()
+	}
+	b.Publish(e)
+}
+
+// interval limits how often a Writer reports.
+const interval = 250 * time.Millisecond
+
+type writer struct {
+	w     io.Writer
+	n     int64
+	total int64
+	last  time.Time
+	fn    func(current, total int64)
+}
+
+// NewWriter returns a writer counting the bytes written to w. The count is
+// reported to fn together with the expected total, which is zero if unknown.
+func NewWriter(w io.Writer, total int64, fn func(current, total int64)) io.Writer {
+	return &writer{w: w, total: total, fn: fn}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	if now := time.Now(); now.Sub(w.last) >= interval || w.n == w.total {
+		w.last = now
+		w.fn(w.n, w.total)
+	}
+
+	return n, err
+}
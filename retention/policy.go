@@ -0,0 +1,150 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package retention
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+)
+
+// Types of cached files. They are the roles of the artifacts.
+const (
+	// Intermediate files are downloaded streams which are merged or
+	// converted into the files served to clients.
+	Intermediate = cache.Intermediate
+	Video        = cache.Video
+	Audio        = cache.Audio
+	Chapter      = cache.Chapter
+	Subtitles    = cache.Subtitles
+	// Metadata files are kept as long as any other file of an item.
+	Metadata = cache.Metadata
+	Other    = "other"
+)
+
+// Policy describes which cached files are removed.
+type Policy struct {
+	// MaxSize limits the total size of the cached files of all services,
+	// e.g. 50G. The least recently used files are removed first.
+	MaxSize string `json:"max_size"`
+	// MaxAge maps file types to the time after which files of the type are
+	// removed if they have not been accessed, e.g. {"intermediate": "24h"}.
+	MaxAge map[string]string `json:"max_age"`
+	// RemoveIntermediates removes downloaded streams once they have been
+	// merged or converted.
+	RemoveIntermediates bool `json:"remove_intermediates"`
+	// Interval is the time between two runs, e.g. 1h.
+	Interval string `json:"interval"`
+}
+
+// Validate checks that all sizes and durations of the policy are valid.
+func (p Policy) Validate() error {
+	_, err := p.parse()
+	return err
+}
+
+// policy is the parsed form of a Policy.
+type policy struct {
+	maxSize       int64
+	maxAge        map[string]time.Duration
+	intermediates bool
+	interval      time.Duration
+}
+
+func (p Policy) parse() (policy, error) {
+	pol := policy{
+		maxAge:        make(map[string]time.Duration),
+		intermediates: p.RemoveIntermediates,
+		interval:      time.Hour,
+	}
+
+	if p.MaxSize != "" {
+		n, err := parseSize(p.MaxSize)
+		if err != nil {
+			return policy{}, err
+		}
+		pol.maxSize = n
+	}
+
+	for typ, v := range p.MaxAge {
+		switch typ {
+		case Intermediate, Video, Audio, Chapter, Subtitles, Other:
+		default:
+			return policy{}, fmt.Errorf("unknown file type: %q", typ)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return policy{}, fmt.Errorf("invalid max age of %s: %s", typ, v)
+		}
+		pol.maxAge[typ] = d
+	}
+
+	if p.Interval != "" {
+		d, err := time.ParseDuration(p.Interval)
+		if err != nil || d <= 0 {
+			return policy{}, fmt.Errorf("invalid interval: %s", p.Interval)
+		}
+		pol.interval = d
+	}
+
+	return pol, nil
+}
+
+// parseSize parses a number of bytes with an optional binary unit such as
+// 500M or 2GB.
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := int64(1)
+	for i, u := range "KMGT" {
+		if strings.HasSuffix(v, string(u)) {
+			v = strings.TrimSuffix(v, string(u))
+			unit = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// Type guesses the type of the cached file name. It is used for artifacts
+// written before they were stored with their role.
+func Type(name string) string {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	switch {
+	case name == library.InfoName:
+		return Metadata
+	case name == "source":
+		// the downloaded file of the direct service
+		return Intermediate
+	case strings.HasPrefix(base, "subtitles-"):
+		return Subtitles
+	case strings.HasPrefix(base, "chapter-"):
+		return Chapter
+	}
+
+	for prefix, typ := range map[string]string{"audio": Audio, "stream": Audio, "combined": Video, "video": Video} {
+		if base == prefix {
+			return typ
+		}
+		// streams are stored along with their itag
+		if v := strings.TrimPrefix(base, prefix+"-"); v != base {
+			if strings.Trim(v, "0123456789") == "" {
+				return Intermediate
+			}
+			return typ
+		}
+	}
+	return Other
+}
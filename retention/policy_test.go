@@ -0,0 +1,61 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package retention
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int64
+		fail bool
+	}{
+		{s: "0", n: 0},
+		{s: "512", n: 512},
+		{s: "512B", n: 512},
+		{s: "2k", n: 2 << 10},
+		{s: " 500M ", n: 500 << 20},
+		{s: "2GB", n: 2 << 30},
+		{s: "1T", n: 1 << 40},
+		{s: "", fail: true},
+		{s: "-1G", fail: true},
+		{s: "1.5G", fail: true},
+		{s: "1P", fail: true},
+	}
+
+	for _, tt := range tests {
+		n, err := parseSize(tt.s)
+		if (err != nil) != tt.fail || n != tt.n {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, failure %v", tt.s, n, err, tt.n, tt.fail)
+		}
+	}
+}
+
+func TestType(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+	}{
+		{name: "info.json", typ: Metadata},
+		{name: "source", typ: Intermediate},
+		{name: "subtitles-en.vtt", typ: Subtitles},
+		{name: "chapter-3.mp3", typ: Chapter},
+		{name: "audio.mp3", typ: Audio},
+		{name: "audio-m4a.m4a", typ: Audio},
+		{name: "audio-140.m4a", typ: Intermediate},
+		{name: "video-137.mp4", typ: Intermediate},
+		{name: "stream-m4a.m4a", typ: Audio},
+		{name: "combined.mp4", typ: Video},
+		{name: "combined-clip-10-20.mp4", typ: Video},
+		{name: "thumbnail.jpg", typ: Other},
+	}
+
+	for _, tt := range tests {
+		if typ := Type(tt.name); typ != tt.typ {
+			t.Errorf("Type(%q) = %s, want %s", tt.name, typ, tt.typ)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/services"
+)
+
+// Reasons for removing a file.
+const (
+	ReasonAge          = "age"
+	ReasonIntermediate = "intermediate"
+	ReasonSize         = "size"
+)
+
+// ErrNotFound is returned for items which are not in the library.
+var ErrNotFound = errors.New("item not found")
+
+// Removal is a cached file removed by a run.
+type Removal struct {
+	Service    string    `json:"service"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Reason     string    `json:"reason"`
+}
+
+// Report describes the files removed by a run.
+type Report struct {
+	DryRun   bool      `json:"dry_run"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Size is the total size of all cached files before the run.
+	Size    int64     `json:"size"`
+	Freed   int64     `json:"freed"`
+	Removed []Removal `json:"removed"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// Manager removes the cached files of all services according to a policy.
+type Manager struct {
+	run      sync.Mutex
+	m        sync.Mutex
+	policy   policy
+	registry *services.Registry
+	library  *library.Store
+	last     *Report
+}
+
+// New returns a manager applying p to the files of all services of reg
+// which keep them in a cache. Items pinned in lib are never removed.
+func New(p Policy, reg *services.Registry, lib *library.Store) (*Manager, error) {
+	pol, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{policy: pol, registry: reg, library: lib}, nil
+}
+
+// Run applies the policy every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	t := time.NewTicker(m.policy.interval)
+	defer t.Stop()
+
+	m.Collect(ctx, false)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.Collect(ctx, false)
+		}
+	}
+}
+
+// Last returns the report of the last run which removed files.
+func (m *Manager) Last() (Report, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.last == nil {
+		return Report{}, false
+	}
+	return *m.last, true
+}
+
+// file is a complete artifact of a cache.
+type file struct {
+	service  string
+	cache    *cache.Cache
+	id       string
+	name     string
+	artifact cache.Artifact
+	typ      string
+	pinned   bool
+}
+
+func (f file) evictable() bool {
+	return f.typ != Metadata && !f.pinned
+}
+
+// Collect applies the policy once. Files which have not been accessed for
+// the maximum age of their type are removed first, followed by intermediate
+// files which have been merged or converted since their last access. The
+// least recently used files are removed until the cache fits into the
+// maximum size. Items whose files are being written are left alone. If dryRun
+// is set, the files are only reported.
+func (m *Manager) Collect(ctx context.Context, dryRun bool) Report {
+	m.run.Lock()
+	defer m.run.Unlock()
+
+	r := Report{DryRun: dryRun, Started: time.Now(), Removed: []Removal{}}
+
+	files, errs := m.files()
+	for _, err := range errs {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	for _, f := range files {
+		r.Size += f.artifact.Size
+	}
+
+	var plan []Removal
+	var planned []file
+	size := r.Size
+	removed := make([]bool, len(files))
+	remove := func(i int, reason string) {
+		f := files[i]
+		removed[i] = true
+		size -= f.artifact.Size
+		planned = append(planned, f)
+		plan = append(plan, Removal{
+			Service:    f.service,
+			ID:         f.id,
+			Name:       f.name,
+			Type:       f.typ,
+			Size:       f.artifact.Size,
+			LastAccess: f.artifact.LastAccess(),
+			Reason:     reason,
+		})
+	}
+
+	for i, f := range files {
+		if age, ok := m.policy.maxAge[f.typ]; ok && f.evictable() && r.Started.Sub(f.artifact.LastAccess()) > age {
+			remove(i, ReasonAge)
+		}
+	}
+
+	if m.policy.intermediates {
+		// the newest file merged or converted for each item
+		outputs := make(map[string]time.Time)
+		for _, f := range files {
+			k := f.service + "/" + f.id
+			if (f.typ == Video || f.typ == Audio) && f.artifact.Created.After(outputs[k]) {
+				outputs[k] = f.artifact.Created
+			}
+		}
+		for i, f := range files {
+			if removed[i] || !f.evictable() || f.typ != Intermediate {
+				continue
+			}
+			if outputs[f.service+"/"+f.id].After(f.artifact.LastAccess()) {
+				remove(i, ReasonIntermediate)
+			}
+		}
+	}
+
+	if m.policy.maxSize > 0 && size > m.policy.maxSize {
+		var lru []int
+		for i, f := range files {
+			if !removed[i] && f.evictable() {
+				lru = append(lru, i)
+			}
+		}
+		sort.SliceStable(lru, func(i, j int) bool {
+			return files[lru[i]].artifact.LastAccess().Before(files[lru[j]].artifact.LastAccess())
+		})
+
+		for _, i := range lru {
+			if size <= m.policy.maxSize {
+				break
+			}
+			remove(i, ReasonSize)
+		}
+	}
+
+	if dryRun {
+		r.Removed = append(r.Removed, plan...)
+		for _, rm := range plan {
+			r.Freed += rm.Size
+		}
+		r.Finished = time.Now()
+		return r
+	}
+
+	touched := make(map[string]file)
+	for i, f := range planned {
+		if ctx.Err() != nil {
+			r.Errors = append(r.Errors, ctx.Err().Error())
+			break
+		}
+		err := f.cache.Remove(f.id, f.name)
+		if err == cache.ErrBusy {
+			// a download started since the files were listed
+			continue
+		}
+		if err != nil {
+			r.Errors = append(r.Errors, err.Error())
+			continue
+		}
+		r.Removed = append(r.Removed, plan[i])
+		r.Freed += f.artifact.Size
+		touched[f.service+"/"+f.id] = f
+	}
+	for _, f := range touched {
+		if err := m.library.Refresh(f.service, f.cache, f.id); err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		}
+	}
+
+	r.Finished = time.Now()
+	if len(r.Removed) > 0 {
+		log.Printf("retention removed %d files of %d bytes", len(r.Removed), r.Freed)
+	}
+	for _, e := range r.Errors {
+		log.Printf("retention failed: %s", e)
+	}
+
+	m.m.Lock()
+	m.last = &r
+	m.m.Unlock()
+
+	return r
+}
+
+// files returns the complete artifacts of all caches. Failures to read
+// single items are returned along with the artifacts of the others.
+func (m *Manager) files() ([]file, []error) {
+	var files []file
+	var errs []error
+	for _, name := range m.registry.Names() {
+		svc, _ := m.registry.Get(name)
+		st, ok := svc.(services.Storer)
+		if !ok {
+			continue
+		}
+		c := st.Cache()
+
+		ids, err := c.IDs()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list files of %s: %v", name, err))
+			continue
+		}
+		for _, id := range ids {
+			// files may be read to write others
+			if c.Busy(id) {
+				continue
+			}
+
+			man, err := c.Manifest(id)
+			if os.IsNotExist(err) {
+				// the folder is being created
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list files of %s/%s: %v", name, id, err))
+				continue
+			}
+
+			it, _ := m.library.Get(name, id)
+			for n, a := range man.Artifacts {
+				if !a.Complete {
+					continue
+				}
+				typ := a.Role
+				if typ == "" {
+					typ = Type(n)
+				}
+				files = append(files, file{
+					service:  name,
+					cache:    c,
+					id:       id,
+					name:     n,
+					artifact: a,
+					typ:      typ,
+					pinned:   it.Pinned,
+				})
+			}
+		}
+	}
+
+	// runs are reported in a stable order
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.id != b.id {
+			return a.id < b.id
+		}
+		return a.name < b.name
+	})
+	return files, errs
+}
+
+// Pin marks the item of a service which clients request with videoID as
+// pinned, so none of its files are removed, or unpins it.
+func (m *Manager) Pin(service, videoID string, pinned bool) (library.Item, error) {
+	// a running collection must not remove files of newly pinned items
+	m.run.Lock()
+	defer m.run.Unlock()
+
+	it, ok := m.library.Find(service, videoID)
+	if !ok {
+		return library.Item{}, ErrNotFound
+	}
+
+	// the metadata stored next to the files keeps the pin across reindexing
+	var c *cache.Cache
+	svc, _ := m.registry.Get(service)
+	if st, ok := svc.(services.Storer); ok {
+		c = st.Cache()
+	}
+	it, err := m.library.Modify(c, service, it.ID, func(it *library.Item) { it.Pinned = pinned })
+	if err == library.ErrNotFound {
+		return library.Item{}, ErrNotFound
+	}
+	return it, err
+}
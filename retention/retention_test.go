@@ -0,0 +1,168 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/services"
+)
+
+// storer is a service keeping its files in a cache.
+type storer struct {
+	services.Service
+	cache *cache.Cache
+}
+
+func (s storer) Cache() *cache.Cache {
+	return s.cache
+}
+
+// testFile is a cached file of size 10 created age ago.
+type testFile struct {
+	id, name, role string
+	age            time.Duration
+}
+
+func newTestManager(t *testing.T, p Policy, files []testFile) (*Manager, *cache.Cache, *library.Store) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c := cache.New(filepath.Join(dir, "cache"))
+	manifests := make(map[string]*cache.Manifest)
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Join(c.Dir(), f.id), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(c.Path(f.id, f.name), []byte("0123456789"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		m, ok := manifests[f.id]
+		if !ok {
+			m = &cache.Manifest{Artifacts: make(map[string]cache.Artifact)}
+			manifests[f.id] = m
+		}
+		m.Artifacts[f.name] = cache.Artifact{Size: 10, SHA256: "x", Complete: true, Created: time.Now().Add(-f.age), Role: f.role}
+	}
+	for id, m := range manifests {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(c.Path(id, "manifest.json"), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib, err := library.Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := services.NewRegistry()
+	reg.Add("test", storer{cache: c})
+
+	m, err := New(p, reg, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, c, lib
+}
+
+// removed returns the files and reasons of the removals of r.
+func removed(r Report) []string {
+	var names []string
+	for _, rm := range r.Removed {
+		names = append(names, rm.ID+"/"+rm.Name+":"+rm.Reason)
+	}
+	return names
+}
+
+func TestCollectOrder(t *testing.T) {
+	p := Policy{
+		MaxSize:             "30",
+		MaxAge:              map[string]string{Subtitles: "4h"},
+		RemoveIntermediates: true,
+	}
+	m, _, _ := newTestManager(t, p, []testFile{
+		{id: "a", name: "info.json", role: Metadata, age: 10 * time.Hour},
+		{id: "a", name: "subtitles-en.vtt", role: Subtitles, age: 5 * time.Hour},
+		{id: "a", name: "audio-140.m4a", role: Intermediate, age: 4 * time.Hour},
+		{id: "a", name: "audio.mp3", role: Audio, age: 3 * time.Hour},
+		{id: "b", name: "chapter-1.mp3", role: Chapter, age: 2 * time.Hour},
+		// the role of legacy files is derived from their names
+		{id: "b", name: "audio.mp3", age: time.Hour},
+		{id: "b", name: "audio-251.webm", age: 2 * time.Minute},
+	})
+
+	r := m.Collect(context.Background(), true)
+	want := []string{
+		"a/subtitles-en.vtt:" + ReasonAge,
+		"a/audio-140.m4a:" + ReasonIntermediate,
+		"a/audio.mp3:" + ReasonSize,
+		"b/chapter-1.mp3:" + ReasonSize,
+	}
+	if got := removed(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got removals %v, want %v", got, want)
+	}
+	if r.Size != 70 || r.Freed != 40 {
+		t.Errorf("got size %d and freed %d, want 70 and 40", r.Size, r.Freed)
+	}
+}
+
+func TestCollectKeepsBusyAndPinned(t *testing.T) {
+	m, c, lib := newTestManager(t, Policy{MaxSize: "0B", MaxAge: map[string]string{Audio: "1m"}}, []testFile{
+		{id: "a", name: "audio.mp3", role: Audio, age: time.Hour},
+		{id: "b", name: "audio.mp3", role: Audio, age: time.Hour},
+		{id: "c", name: "audio.mp3", role: Audio, age: time.Hour},
+	})
+	if err := lib.Put(library.Item{Service: "test", ID: "b", Pinned: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file of c is being written
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Artifact(context.Background(), "c", "audio.ogg", cache.Audio, func(ctx context.Context, w io.Writer) error {
+			close(started)
+			<-release
+			return nil
+		})
+		done <- err
+	}()
+	<-started
+
+	r := m.Collect(context.Background(), false)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := removed(r), []string{"a/audio.mp3:" + ReasonAge}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got removals %v, want %v", got, want)
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, ok := c.Lookup(id, "audio.mp3"); !ok {
+			t.Errorf("file of %s has been removed", id)
+		}
+	}
+}
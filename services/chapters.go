@@ -0,0 +1,77 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+// ErrNoChapter is returned for chapters a video does not have.
+var ErrNoChapter = errors.New("chapter not found")
+
+// chapterTags returns the tags of chapter n of a file tagged with tags. The
+// chapter is tagged as track of an album named after the file.
+func chapterTags(tags multimedia.Tags, n int) (multimedia.Tags, error) {
+	if n < 1 || n > len(tags.Chapters) {
+		return multimedia.Tags{}, ErrNoChapter
+	}
+	ch := tags.Chapters[n-1]
+
+	tags.Album = tags.Title
+	tags.Title = ch.Title
+	tags.Track = fmt.Sprintf("%d/%d", n, len(tags.Chapters))
+	tags.Chapters = nil
+	return tags, nil
+}
+
+// ChapterFile stores the chapter of the audio file returned by whole which is
+// selected by opts. ext is the extension of both files. The chapter is tagged
+// as track of an album named after the video described by item. The progress
+// of cutting is reported to stage.
+func ChapterFile(ctx context.Context, c *cache.Cache, conv multimedia.Converter, key, ext string, opts Options, item func(ctx context.Context) (library.Item, error), stage func(current, total int64), whole func(ctx context.Context) (string, error)) (string, error) {
+	name := opts.Unclipped().Name(fmt.Sprintf("chapter-%d", opts.Chapter), ext)
+	return c.Artifact(ctx, key, name, cache.Chapter, func(ctx context.Context, w io.Writer) error {
+		it, err := item(ctx)
+		if err != nil {
+			return err
+		}
+
+		all := Tags(ctx, it)
+		tags, err := chapterTags(all, opts.Chapter)
+		if err != nil {
+			return err
+		}
+		ch := all.Chapters[opts.Chapter-1]
+
+		p, err := whole(ctx)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open file to split: %v", err)
+		}
+		defer f.Close()
+
+		ctx = multimedia.WithProgress(ctx, stage)
+		err = multimedia.Tagged(ctx, conv, w, ext, tags, func(w io.Writer) error {
+			return conv.Clip(ctx, f, w, ext, ch.Range())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to split chapter: %v", err)
+		}
+		return nil
+	})
+}
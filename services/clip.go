@@ -0,0 +1,57 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+// Clip stores the range r of the file returned by whole as the artifact name
+// of key with the given role. ext is the extension of both files. The clip is tagged like the
+// video described by item, without its chapters. The progress of cutting is
+// reported to stage.
+func Clip(ctx context.Context, c *cache.Cache, conv multimedia.Converter, key, name, role, ext string, r multimedia.Range, item func(ctx context.Context) (library.Item, error), stage func(current, total int64), whole func(ctx context.Context) (string, error)) (string, error) {
+	return c.Artifact(ctx, key, name, role, func(ctx context.Context, w io.Writer) error {
+		it, err := item(ctx)
+		if err != nil {
+			return err
+		}
+
+		p, err := whole(ctx)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open file to clip: %v", err)
+		}
+		defer f.Close()
+
+		ctx = multimedia.WithProgress(ctx, stage)
+		err = multimedia.Tagged(ctx, conv, w, ext, clipTags(Tags(ctx, it)), func(w io.Writer) error {
+			return conv.Clip(ctx, f, w, ext, r)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clip file: %v", err)
+		}
+		return nil
+	})
+}
+
+// clipTags returns the tags of a clip of a file tagged with tags. Chapters
+// do not match the clip and are left out.
+func clipTags(tags multimedia.Tags) multimedia.Tags {
+	tags.Chapters = nil
+	return tags
+}
@@ -0,0 +1,528 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package direct
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/services"
+)
+
+// Config is the configuration block of the direct service.
+type Config struct {
+	VideoPath   string `json:"video_path"`
+	MaxParallel int    `json:"max_parallel"`
+}
+
+func init() {
+	services.Register("direct", open)
+}
+
+func open(raw json.RawMessage, env services.Env) (services.Service, error) {
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+
+	c := cache.New(cfg.VideoPath)
+	if err := c.Sweep(); err != nil {
+		return nil, err
+	}
+
+	return New(c, env.Library, cfg.MaxParallel, env.Events), nil
+}
+
+// directService downloads media files from arbitrary HTTP(S) URLs. The URL
+// is used as the id of a video.
+type directService struct {
+	cache     *cache.Cache
+	library   *library.Store
+	cl        http.Client
+	converter multimedia.Converter
+	events    *progress.Broker
+	slots     chan struct{}
+
+	// allowPrivate permits connections to private addresses, which are
+	// refused to keep users from reaching internal hosts.
+	allowPrivate bool
+
+	m sync.Mutex
+	// titles holds the titles of downloaded sources until they are recorded.
+	titles map[string]string
+}
+
+// New returns the direct service storing its files in c and their metadata
+// in lib. At most maxParallel files are downloaded and converted at the same
+// time.
+func New(c *cache.Cache, lib *library.Store, maxParallel int, events *progress.Broker) services.Service {
+	if maxParallel <= 0 {
+		maxParallel = 2
+	}
+
+	s := &directService{
+		cache:     c,
+		library:   lib,
+		converter: multimedia.NewFFMPEG(),
+		events:    events,
+		slots:     make(chan struct{}, maxParallel),
+		titles:    make(map[string]string),
+	}
+	// addresses are checked after resolving, which covers redirects as well
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: s.control}
+	s.cl = http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	return s
+}
+
+// control refuses connections to loopback, private and link-local addresses.
+func (s *directService) control(network, address string, c syscall.RawConn) error {
+	if s.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to connect to private address %s", host)
+	}
+	return nil
+}
+
+func (s *directService) Capabilities() services.Capabilities {
+	return services.Capabilities{Audio: true, Video: true, Manage: true}
+}
+
+func (s *directService) Search(ctx context.Context, q services.Query) (services.SearchResult, error) {
+	return services.SearchResult{}, services.ErrNotSupported
+}
+
+func (s *directService) Info(ctx context.Context, id string) (services.VideoInfo, error) {
+	u, err := parse(id)
+	if err != nil {
+		return services.VideoInfo{}, err
+	}
+
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return services.VideoInfo{}, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req = req.WithContext(ctx)
+	resp, err := s.cl.Do(req)
+	if err != nil {
+		return services.VideoInfo{}, fmt.Errorf("failed to query media url: %v", err)
+	}
+	resp.Body.Close()
+
+	// some servers refuse HEAD requests, the title is derived from the url then
+	name := title(u, "")
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if !media(resp.Header.Get("Content-Type")) {
+			return services.VideoInfo{}, fmt.Errorf("no media file: %s", resp.Header.Get("Content-Type"))
+		}
+		name = title(u, resp.Header.Get("Content-Disposition"))
+	}
+
+	files, err := library.Files(s.cache, Key(u.String()))
+	if err != nil {
+		log.Printf("failed to read cached files of %s: %v", u, err)
+	}
+
+	return services.VideoInfo{
+		ID:        u.String(),
+		Title:     name,
+		URL:       u.String(),
+		Service:   "direct",
+		Artifacts: files,
+	}, nil
+}
+
+// acquire blocks until one of the parallel download slots is free.
+func (s *directService) acquire(ctx context.Context) (func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// source downloads the file behind u into the cache.
+func (s *directService) source(ctx context.Context, u *url.URL) (string, error) {
+	id := u.String()
+	return s.cache.Artifact(ctx, Key(id), "source", cache.Intermediate, func(ctx context.Context, w io.Writer) error {
+		req, err := http.NewRequest("GET", id, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %v", err)
+		}
+
+		req = req.WithContext(ctx)
+		resp, err := s.cl.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to download media: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("failed to download media: invalid status code: %d", resp.StatusCode)
+		}
+		if !media(resp.Header.Get("Content-Type")) {
+			return fmt.Errorf("failed to download media: no media file: %s", resp.Header.Get("Content-Type"))
+		}
+
+		log.Printf("downloading source: %v", id)
+
+		w = progress.NewWriter(w, resp.ContentLength, s.events.Stage(id, "download source", progress.Bytes))
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return fmt.Errorf("failed to download media: %v", err)
+		}
+
+		log.Printf("finished downloading source: %v", id)
+
+		// the title is recorded without requesting the headers again
+		s.m.Lock()
+		s.titles[Key(id)] = title(u, resp.Header.Get("Content-Disposition"))
+		s.m.Unlock()
+
+		return nil
+	})
+}
+
+func (s *directService) VideoFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.videoFile(ctx, id, opts.Clip)
+	if err == nil {
+		s.record(ctx, id)
+	}
+	s.events.Finish(id, err)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *directService) videoFile(ctx context.Context, id string, clip multimedia.Range) (string, error) {
+	u, err := parse(id)
+	if err != nil {
+		return "", err
+	}
+
+	if !clip.IsZero() {
+		name := services.Options{Clip: clip}.Name("combined", "mp4")
+		return services.Clip(ctx, s.cache, s.converter, Key(u.String()), name, cache.Video, "mp4", clip, s.libraryItem(u), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.videoFile(ctx, id, multimedia.Range{})
+		})
+	}
+
+	// mp4 files are served as they are
+	if strings.ToLower(path.Ext(u.Path)) == ".mp4" {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		return s.source(ctx, u)
+	}
+
+	return s.cache.Artifact(ctx, Key(u.String()), "combined.mp4", cache.Video, func(ctx context.Context, w io.Writer) error {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		p, err := s.source(ctx, u)
+		if err != nil {
+			return err
+		}
+
+		rc, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open source file: %v", err)
+		}
+		defer rc.Close()
+
+		ctx = multimedia.WithProgress(ctx, s.events.Stage(id, "remux", progress.Milliseconds))
+		err = multimedia.Tagged(ctx, s.converter, w, "mp4", s.tags(ctx, u), func(w io.Writer) error {
+			return s.converter.Remux(ctx, rc, w)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remux source: %v", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *directService) AudioFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.audioFile(ctx, id, opts)
+	if err == nil {
+		s.record(ctx, id)
+	}
+	s.events.Finish(id, err)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// audioFile converts the source as described by the output spec of opts.
+// Clips and chapters are cut from the whole file.
+func (s *directService) audioFile(ctx context.Context, id string, opts services.Options) (string, error) {
+	u, err := parse(id)
+	if err != nil {
+		return "", err
+	}
+
+	spec := opts.Output
+	whole := services.Options{Output: spec}
+	if opts.Chapter > 0 {
+		return services.ChapterFile(ctx, s.cache, s.converter, Key(u.String()), spec.Extension(), services.Options{Output: spec, Chapter: opts.Chapter}, s.libraryItem(u), s.events.Stage(id, "split", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, whole)
+		})
+	}
+
+	name := services.Options{Output: spec, Clip: opts.Clip}.Name("audio", spec.Extension())
+	if !opts.Clip.IsZero() {
+		return services.Clip(ctx, s.cache, s.converter, Key(u.String()), name, cache.Audio, spec.Extension(), opts.Clip, s.libraryItem(u), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, whole)
+		})
+	}
+
+	return s.cache.Artifact(ctx, Key(u.String()), name, cache.Audio, func(ctx context.Context, w io.Writer) error {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		p, err := s.source(ctx, u)
+		if err != nil {
+			return err
+		}
+
+		rc, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open source file: %v", err)
+		}
+		defer rc.Close()
+
+		log.Printf("converting source: %v", id)
+
+		ctx = multimedia.WithProgress(ctx, s.events.Stage(id, "convert", progress.Milliseconds))
+		err = multimedia.Tagged(ctx, s.converter, w, spec.Extension(), s.tags(ctx, u), func(w io.Writer) error {
+			return s.converter.Convert(ctx, rc, w, spec)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to convert source: %v", err)
+		}
+
+		log.Printf("finished converting source: %v", id)
+
+		return nil
+	})
+}
+
+func (s *directService) List(ctx context.Context) ([]services.VideoInfo, error) {
+	var vids []services.VideoInfo
+	for _, it := range s.library.List("direct") {
+		vids = append(vids, services.ItemInfo(it))
+	}
+	return vids, nil
+}
+
+// record stores the metadata of id in the library once one of its files has
+// been written. Nothing is written if the files of id did not change.
+func (s *directService) record(ctx context.Context, id string) {
+	u, err := parse(id)
+	if err != nil {
+		return
+	}
+	s.m.Lock()
+	name, known := s.titles[Key(u.String())]
+	delete(s.titles, Key(u.String()))
+	s.m.Unlock()
+
+	if s.library.Current(s.cache, "direct", Key(u.String())) {
+		return
+	}
+
+	it, ok := s.library.Get("direct", Key(u.String()))
+	if !ok {
+		// sources downloaded earlier are described by a new request
+		if !known {
+			vi, err := s.Info(ctx, id)
+			if err != nil {
+				log.Printf("failed to retrieve library metadata: %v", err)
+				return
+			}
+			name = vi.Title
+		}
+		it = library.Item{
+			Service:    "direct",
+			ID:         Key(u.String()),
+			Source:     u.String(),
+			Title:      name,
+			URL:        u.String(),
+			Downloaded: time.Now(),
+		}
+	}
+
+	if _, err := s.library.Add(s.cache, it); err != nil {
+		log.Printf("failed to record library item: %v", err)
+	}
+}
+
+// tags returns the tags written into the files of u. Files not known to the
+// library are tagged with the title derived from the url.
+func (s *directService) tags(ctx context.Context, u *url.URL) multimedia.Tags {
+	it, _ := s.libraryItem(u)(ctx)
+	return services.Tags(ctx, it)
+}
+
+// libraryItem returns a function looking up the library metadata of u. Files
+// not known to the library are described by their url.
+func (s *directService) libraryItem(u *url.URL) func(ctx context.Context) (library.Item, error) {
+	return func(ctx context.Context) (library.Item, error) {
+		if it, ok := s.library.Get("direct", Key(u.String())); ok {
+			return it, nil
+		}
+		return library.Item{Title: title(u, ""), URL: u.String()}, nil
+	}
+}
+
+// Retag rewrites the tags of all converted files of id from its library
+// metadata. Media files served as they are keep their original tags.
+func (s *directService) Retag(ctx context.Context, id string) error {
+	u, err := parse(id)
+	if err != nil {
+		return err
+	}
+
+	it, ok := s.library.Get("direct", Key(u.String()))
+	if !ok {
+		return fmt.Errorf("media %s is not in the library", id)
+	}
+
+	if err := services.Retag(ctx, s.cache, s.converter, it.ID, services.Tags(ctx, it)); err != nil {
+		return err
+	}
+	_, err = s.library.Modify(s.cache, "direct", it.ID, func(*library.Item) {})
+	return err
+}
+
+// Update changes the stored metadata of a downloaded file.
+func (s *directService) Update(ctx context.Context, id string, e services.Edit) (library.Item, error) {
+	u, err := parse(id)
+	if err != nil {
+		return library.Item{}, err
+	}
+	return services.Update(s.library, s.cache, "direct", Key(u.String()), e)
+}
+
+// Remove deletes the named files of a downloaded file, or all of them along
+// with its library entry.
+func (s *directService) Remove(ctx context.Context, id string, names ...string) error {
+	u, err := parse(id)
+	if err != nil {
+		return err
+	}
+	return services.Remove(s.library, s.cache, "direct", Key(u.String()), names...)
+}
+
+// Cache returns the cache holding the files of the service.
+func (s *directService) Cache() *cache.Cache {
+	return s.cache
+}
+
+// Reindex rebuilds the library entries of all downloaded files. Files without
+// stored metadata can not be mapped back to their url and are skipped.
+func (s *directService) Reindex(ctx context.Context) error {
+	items, err := library.Scan("direct", s.cache, func(id string) (library.Item, error) {
+		return library.Item{}, errors.New("url of file is unknown")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan files: %v", err)
+	}
+	return s.library.Replace("direct", items)
+}
+
+// Key returns the stable cache key of a media url.
+func Key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// parse validates that id is an absolute HTTP(S) url.
+func parse(id string) (*url.URL, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid media url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid media url: %s", id)
+	}
+	return u, nil
+}
+
+// media reports whether a response of content type ct can carry a media
+// file. Responses without a content type are accepted.
+func media(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/") {
+		return true
+	}
+	switch t {
+	case "application/octet-stream", "application/ogg", "application/mp4", "binary/octet-stream":
+		return true
+	}
+	return false
+}
+
+// title derives the title of a media file from the Content-Disposition
+// header or, if it carries no file name, from the url path.
+func title(u *url.URL, disposition string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	if name == "" || name == "/" || name == "." {
+		return u.Host
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package direct
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/services"
+)
+
+const content = "not really a video"
+
+// newServer serves a media file at /clip.mp4, the same file refusing HEAD
+// requests at /get.mp4, a web page at /page.mp4 and fails for all other
+// paths.
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/clip.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Disposition", `attachment; filename="Holiday 2017.mp4"`)
+			if r.Method == "GET" {
+				w.Write([]byte(content))
+			}
+		case "/get.mp4":
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Disposition", `attachment; filename="Holiday 2017.mp4"`)
+			w.Write([]byte(content))
+		case "/page.mp4":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if r.Method == "GET" {
+				w.Write([]byte("<html></html>"))
+			}
+		default:
+			http.Error(w, "gone", http.StatusGone)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestService(t *testing.T) (*directService, *library.Store) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	lib, err := library.Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(cache.New(filepath.Join(dir, "cache")), lib, 1, progress.NewBroker()).(*directService)
+	// the test server listens on the loopback interface
+	s.allowPrivate = true
+	return s, lib
+}
+
+func TestInfo(t *testing.T) {
+	srv := newServer(t)
+	s, _ := newTestService(t)
+
+	id := srv.URL + "/clip.mp4?t=1&x=a%20b"
+	vi, err := s.Info(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vi.ID != id || vi.URL != id {
+		t.Errorf("got id %s and url %s, want %s", vi.ID, vi.URL, id)
+	}
+	if vi.Title != "Holiday 2017" {
+		t.Errorf("got title %q, want %q", vi.Title, "Holiday 2017")
+	}
+
+	// the title falls back to the url if the server refuses the request
+	vi, err = s.Info(context.Background(), srv.URL+"/missing.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vi.Title != "missing" {
+		t.Errorf("got title %q, want %q", vi.Title, "missing")
+	}
+}
+
+func TestVideoFile(t *testing.T) {
+	srv := newServer(t)
+	s, lib := newTestService(t)
+
+	id := srv.URL + "/clip.mp4"
+	rc, err := s.VideoFile(context.Background(), id, services.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != content {
+		t.Errorf("got content %q, want %q", b, content)
+	}
+
+	it, ok := lib.Get("direct", Key(id))
+	if !ok {
+		t.Fatal("downloaded file is not in the library")
+	}
+	if it.Title != "Holiday 2017" || it.URL != id {
+		t.Errorf("got title %q and url %s, want %q and %s", it.Title, it.URL, "Holiday 2017", id)
+	}
+	if _, ok := it.File("source"); !ok {
+		t.Errorf("source file is not in the library item: %v", it.Files)
+	}
+}
+
+func TestRecordTitleOfDownload(t *testing.T) {
+	srv := newServer(t)
+	s, lib := newTestService(t)
+
+	// the title is taken from the download instead of a HEAD request
+	id := srv.URL + "/get.mp4"
+	rc, err := s.VideoFile(context.Background(), id, services.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	it, ok := lib.Get("direct", Key(id))
+	if !ok {
+		t.Fatal("downloaded file is not in the library")
+	}
+	if it.Title != "Holiday 2017" {
+		t.Errorf("got title %q, want %q", it.Title, "Holiday 2017")
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	srv := newServer(t)
+	s, lib := newTestService(t)
+	s.allowPrivate = false
+
+	id := srv.URL + "/clip.mp4"
+	if _, err := s.Info(context.Background(), id); err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("got error %v, want private address", err)
+	}
+	if _, err := s.VideoFile(context.Background(), id, services.Options{}); err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("got error %v, want private address", err)
+	}
+	if _, ok := lib.Get("direct", Key(id)); ok {
+		t.Error("file of a private address was added to the library")
+	}
+}
+
+func TestNoMedia(t *testing.T) {
+	srv := newServer(t)
+	s, lib := newTestService(t)
+
+	id := srv.URL + "/page.mp4"
+	if _, err := s.Info(context.Background(), id); err == nil {
+		t.Error("got info of a web page")
+	}
+
+	_, err := s.VideoFile(context.Background(), id, services.Options{})
+	if err == nil || !strings.Contains(err.Error(), "no media file") {
+		t.Errorf("got error %v, want no media file", err)
+	}
+	if _, ok := lib.Get("direct", Key(id)); ok {
+		t.Error("web page was added to the library")
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv := newServer(t)
+	s, lib := newTestService(t)
+
+	id := srv.URL + "/missing.mp4"
+	_, err := s.VideoFile(context.Background(), id, services.Options{})
+	if err == nil || !strings.Contains(err.Error(), "invalid status code: 410") {
+		t.Errorf("got error %v, want invalid status code", err)
+	}
+	if _, ok := lib.Get("direct", Key(id)); ok {
+		t.Error("missing file was added to the library")
+	}
+
+	m, err := s.cache.Manifest(Key(id))
+	if err == nil && len(m.Artifacts) > 0 {
+		t.Errorf("failed download left artifacts: %v", m.Artifacts)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+)
+
+var (
+	// ErrNotDownloaded is returned for videos or files which are not in the
+	// library.
+	ErrNotDownloaded = errors.New("not found in library")
+	// ErrInUse is returned for files which are being written.
+	ErrInUse = errors.New("file is being written")
+)
+
+// Curator is implemented by services which allow editing and deleting their
+// downloaded videos.
+type Curator interface {
+	// Update changes the stored metadata of a video.
+	Update(ctx context.Context, id string, e Edit) (library.Item, error)
+	// Remove deletes the named files of a video, or the video along with
+	// all its files if no names are given.
+	Remove(ctx context.Context, id string, names ...string) error
+}
+
+// Edit describes changes of the stored metadata of a video. Fields which are
+// nil are left as they are.
+type Edit struct {
+	Title *string   `json:"title,omitempty"`
+	Tags  *[]string `json:"tags,omitempty"`
+	Notes *string   `json:"notes,omitempty"`
+	// AddTags and RemoveTags change single tags, which is useful to edit
+	// many videos at once. Tags are compared case-insensitively.
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+}
+
+// Validate checks that the edit does not clear the title or add empty tags.
+func (e Edit) Validate() error {
+	if e.Title != nil && strings.TrimSpace(*e.Title) == "" {
+		return errors.New("title must not be empty")
+	}
+
+	var tags []string
+	if e.Tags != nil {
+		tags = append(tags, *e.Tags...)
+	}
+	for _, t := range append(tags, e.AddTags...) {
+		if strings.TrimSpace(t) == "" {
+			return errors.New("tags must not be empty")
+		}
+	}
+	return nil
+}
+
+// Apply returns it with the changes of e.
+func (e Edit) Apply(it library.Item) library.Item {
+	if e.Title != nil {
+		it.Title = strings.TrimSpace(*e.Title)
+	}
+	if e.Notes != nil {
+		it.Notes = *e.Notes
+	}
+
+	tags := it.Tags
+	if e.Tags != nil {
+		tags = nil
+		for _, t := range *e.Tags {
+			tags = addTag(tags, t)
+		}
+	} else {
+		tags = append([]string(nil), tags...)
+	}
+	for _, t := range e.AddTags {
+		tags = addTag(tags, t)
+	}
+	for _, t := range e.RemoveTags {
+		for i := 0; i < len(tags); i++ {
+			if strings.EqualFold(tags[i], strings.TrimSpace(t)) {
+				tags = append(tags[:i], tags[i+1:]...)
+				i--
+			}
+		}
+	}
+	it.Tags = tags
+	return it
+}
+
+// addTag appends t to tags unless it is present already.
+func addTag(tags []string, t string) []string {
+	t = strings.TrimSpace(t)
+	for _, tag := range tags {
+		if strings.EqualFold(tag, t) {
+			return tags
+		}
+	}
+	return append(tags, t)
+}
+
+// Update applies e to the library item of a service stored as key in c.
+func Update(lib *library.Store, c *cache.Cache, service, key string, e Edit) (library.Item, error) {
+	if err := e.Validate(); err != nil {
+		return library.Item{}, err
+	}
+
+	it, err := lib.Modify(c, service, key, func(it *library.Item) { *it = e.Apply(*it) })
+	if err == library.ErrNotFound {
+		return library.Item{}, ErrNotDownloaded
+	}
+	return it, err
+}
+
+// Remove deletes the named files of key from c and updates its library item
+// of the service. If no names are given, all files are deleted along with the
+// item. Nothing is deleted if one of the files is unknown or being written.
+func Remove(lib *library.Store, c *cache.Cache, service, key string, names ...string) error {
+	m, err := c.Manifest(key)
+	if os.IsNotExist(err) {
+		if _, ok := lib.Get(service, key); ok && len(names) == 0 {
+			// the files are gone already
+			return lib.Delete(service, key)
+		}
+		return ErrNotDownloaded
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		// the metadata is removed along with the last file
+		for name := range m.Artifacts {
+			if name != library.InfoName {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		a, ok := m.Artifacts[name]
+		if !ok || name == library.InfoName {
+			return ErrNotDownloaded
+		}
+		if !a.Complete {
+			return ErrInUse
+		}
+	}
+
+	for _, name := range names {
+		if err := c.Remove(key, name); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+	return lib.Refresh(service, c, key)
+}
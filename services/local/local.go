@@ -0,0 +1,512 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package local
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/services"
+)
+
+// Config is the configuration block of the local service.
+type Config struct {
+	Path        string `json:"path"`
+	VideoPath   string `json:"video_path"`
+	MaxParallel int    `json:"max_parallel"`
+}
+
+func init() {
+	services.Register("local", open)
+}
+
+func open(raw json.RawMessage, env services.Env) (services.Service, error) {
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+
+	if fi, err := os.Stat(cfg.Path); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("media path is not a directory: %s", cfg.Path)
+	}
+
+	c := cache.New(cfg.VideoPath)
+	if err := c.Sweep(); err != nil {
+		return nil, err
+	}
+
+	return New(cfg.Path, c, env.Library, cfg.MaxParallel, env.Events), nil
+}
+
+// extensions lists the media files offered by the service.
+var extensions = map[string]bool{
+	".avi":  true,
+	".flac": true,
+	".m4a":  true,
+	".mkv":  true,
+	".mov":  true,
+	".mp3":  true,
+	".mp4":  true,
+	".ogg":  true,
+	".opus": true,
+	".wav":  true,
+	".webm": true,
+}
+
+// localService offers the media files below a directory. The path of a file
+// relative to that directory is used as the id of a video.
+type localService struct {
+	root      string
+	cache     *cache.Cache
+	library   *library.Store
+	converter multimedia.Converter
+	events    *progress.Broker
+	slots     chan struct{}
+}
+
+// New returns the local service offering the files below root. Converted
+// files are stored in c and their metadata in lib. At most maxParallel files
+// are converted at the same time.
+func New(root string, c *cache.Cache, lib *library.Store, maxParallel int, events *progress.Broker) services.Service {
+	if maxParallel <= 0 {
+		maxParallel = 2
+	}
+
+	return &localService{
+		root:      root,
+		cache:     c,
+		library:   lib,
+		converter: multimedia.NewFFMPEG(),
+		events:    events,
+		slots:     make(chan struct{}, maxParallel),
+	}
+}
+
+func (s *localService) Capabilities() services.Capabilities {
+	return services.Capabilities{Search: true, Audio: true, Video: true, Manage: true}
+}
+
+// Search returns all files whose path or stored title contains every word of
+// the query. The page token is the offset of a page within all results. Files
+// which have not been converted yet carry no metadata, so they are left out if
+// the query filters by channel, duration or date. Orders other than date and
+// title keep the files sorted by path.
+func (s *localService) Search(ctx context.Context, q services.Query) (services.SearchResult, error) {
+	offset := 0
+	if q.PageToken != "" {
+		n, err := strconv.Atoi(q.PageToken)
+		if err != nil || n < 0 {
+			return services.SearchResult{}, fmt.Errorf("invalid page token: %s", q.PageToken)
+		}
+		offset = n
+	}
+
+	words := strings.Fields(strings.ToLower(q.Text))
+	filtered := q.Channel != "" || q.Duration != "" || !q.After.IsZero() || !q.Before.IsZero()
+
+	var items []library.Item
+	err := s.walk(func(id string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		it, ok := s.library.Get("local", Key(id))
+		if !ok {
+			if filtered {
+				return nil
+			}
+			it = library.Item{Service: "local", ID: Key(id), Source: id, Title: name(id)}
+		}
+
+		text := strings.ToLower(id + " " + it.Title + " " + it.Channel)
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return nil
+			}
+		}
+
+		if q.Channel != "" && !strings.EqualFold(it.Channel, q.Channel) {
+			return nil
+		}
+		if !q.MatchDuration(time.Duration(it.Duration)*time.Second) || !q.MatchPublished(it.Published) {
+			return nil
+		}
+
+		items = append(items, it)
+		return nil
+	})
+	if err != nil {
+		return services.SearchResult{}, fmt.Errorf("failed to search media files: %v", err)
+	}
+
+	switch q.Order {
+	case services.OrderDate:
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Published.After(items[j].Published) })
+	case services.OrderTitle:
+		sort.SliceStable(items, func(i, j int) bool { return strings.ToLower(items[i].Title) < strings.ToLower(items[j].Title) })
+	}
+
+	res := services.SearchResult{
+		Items:        []services.VideoInfo{},
+		PageSize:     q.PageSize,
+		TotalResults: len(items),
+	}
+	for i := offset; i < len(items) && i < offset+q.PageSize; i++ {
+		res.Items = append(res.Items, services.ItemInfo(items[i]))
+	}
+	if offset+q.PageSize < len(items) {
+		res.NextPageToken = strconv.Itoa(offset + q.PageSize)
+	}
+
+	return res, nil
+}
+
+func (s *localService) Info(ctx context.Context, id string) (services.VideoInfo, error) {
+	it, err := s.item(ctx, id)
+	if err != nil {
+		return services.VideoInfo{}, err
+	}
+
+	it.Files, err = library.Files(s.cache, it.ID)
+	if err != nil {
+		log.Printf("failed to read cached files of %s: %v", id, err)
+	}
+	return services.ItemInfo(it), nil
+}
+
+// item returns the library metadata of the file id.
+func (s *localService) item(ctx context.Context, id string) (library.Item, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return library.Item{}, err
+	}
+
+	md, err := multimedia.Probe(ctx, p)
+	if err != nil {
+		return library.Item{}, err
+	}
+
+	title := md.Title
+	if title == "" {
+		title = name(id)
+	}
+
+	it := library.Item{
+		Service:     "local",
+		ID:          Key(id),
+		Source:      id,
+		Title:       title,
+		Channel:     md.Artist,
+		Description: md.Comment,
+		Duration:    int64(md.Duration / time.Second),
+	}
+	for _, layout := range []string{"2006-01-02", "2006"} {
+		if t, err := time.Parse(layout, md.Date); err == nil {
+			it.Published = t
+			break
+		}
+	}
+	return it, nil
+}
+
+// acquire blocks until one of the parallel conversion slots is free.
+func (s *localService) acquire(ctx context.Context) (func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// convert stores the output of fn applied to the file id as the named
+// artifact with the given role.
+func (s *localService) convert(ctx context.Context, id, name, role, stage string, fn func(ctx context.Context, src io.Reader, dst io.Writer) error) (string, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return "", err
+	}
+
+	return s.cache.Artifact(ctx, Key(id), name, role, func(ctx context.Context, w io.Writer) error {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open media file: %v", err)
+		}
+		defer f.Close()
+
+		log.Printf("converting %s: %v", name, id)
+
+		ctx = multimedia.WithProgress(ctx, s.events.Stage(id, stage, progress.Milliseconds))
+		if err := fn(ctx, f, w); err != nil {
+			return fmt.Errorf("failed to convert media file: %v", err)
+		}
+
+		log.Printf("finished converting %s: %v", name, id)
+
+		return nil
+	})
+}
+
+func (s *localService) VideoFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.videoFile(ctx, id, opts.Clip)
+	return s.finish(ctx, id, p, err)
+}
+
+func (s *localService) videoFile(ctx context.Context, id string, clip multimedia.Range) (string, error) {
+	if !clip.IsZero() {
+		name := services.Options{Clip: clip}.Name("combined", "mp4")
+		return services.Clip(ctx, s.cache, s.converter, Key(id), name, cache.Video, "mp4", clip, s.libraryItem(id), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.videoFile(ctx, id, multimedia.Range{})
+		})
+	}
+
+	return s.convert(ctx, id, "combined.mp4", cache.Video, "remux", func(ctx context.Context, src io.Reader, dst io.Writer) error {
+		return multimedia.Tagged(ctx, s.converter, dst, "mp4", s.tags(ctx, id), func(w io.Writer) error {
+			return s.converter.Remux(ctx, src, w)
+		})
+	})
+}
+
+func (s *localService) AudioFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.audioFile(ctx, id, opts)
+	return s.finish(ctx, id, p, err)
+}
+
+// audioFile converts the file id as described by the output spec of opts.
+// Clips and chapters are cut from the whole file.
+func (s *localService) audioFile(ctx context.Context, id string, opts services.Options) (string, error) {
+	spec := opts.Output
+	ext := spec.Extension()
+	whole := services.Options{Output: spec}
+	if opts.Chapter > 0 {
+		return services.ChapterFile(ctx, s.cache, s.converter, Key(id), ext, services.Options{Output: spec, Chapter: opts.Chapter}, s.libraryItem(id), s.events.Stage(id, "split", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, whole)
+		})
+	}
+
+	name := services.Options{Output: spec, Clip: opts.Clip}.Name("audio", ext)
+	if !opts.Clip.IsZero() {
+		return services.Clip(ctx, s.cache, s.converter, Key(id), name, cache.Audio, ext, opts.Clip, s.libraryItem(id), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, whole)
+		})
+	}
+
+	return s.convert(ctx, id, name, cache.Audio, "convert", func(ctx context.Context, src io.Reader, dst io.Writer) error {
+		return multimedia.Tagged(ctx, s.converter, dst, ext, s.tags(ctx, id), func(w io.Writer) error {
+			return s.converter.Convert(ctx, src, w, spec)
+		})
+	})
+}
+
+// tags returns the tags written into the converted files of id, which are
+// taken from the library or the media file itself.
+func (s *localService) tags(ctx context.Context, id string) multimedia.Tags {
+	it, ok := s.library.Get("local", Key(id))
+	if !ok {
+		var err error
+		it, err = s.item(ctx, id)
+		if err != nil {
+			log.Printf("failed to read tags of %s: %v", id, err)
+			it = library.Item{Title: name(id)}
+		}
+	}
+	return services.Tags(ctx, it)
+}
+
+// libraryItem returns a function looking up the library metadata of id,
+// which is read from the file if id is not in the library yet.
+func (s *localService) libraryItem(id string) func(ctx context.Context) (library.Item, error) {
+	return func(ctx context.Context) (library.Item, error) {
+		if it, ok := s.library.Get("local", Key(id)); ok {
+			return it, nil
+		}
+		return s.item(ctx, id)
+	}
+}
+
+// Retag rewrites the tags of all converted files of id from its library
+// metadata.
+func (s *localService) Retag(ctx context.Context, id string) error {
+	it, ok := s.library.Get("local", Key(id))
+	if !ok {
+		return fmt.Errorf("media file %s is not in the library", id)
+	}
+
+	if err := services.Retag(ctx, s.cache, s.converter, it.ID, services.Tags(ctx, it)); err != nil {
+		return err
+	}
+	_, err := s.library.Modify(s.cache, "local", it.ID, func(*library.Item) {})
+	return err
+}
+
+// finish records id in the library and opens the artifact at p if it has
+// been written successfully.
+func (s *localService) finish(ctx context.Context, id, p string, err error) (io.ReadCloser, error) {
+	if err == nil {
+		s.record(ctx, id)
+	}
+	s.events.Finish(id, err)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localService) List(ctx context.Context) ([]services.VideoInfo, error) {
+	var vids []services.VideoInfo
+	for _, it := range s.library.List("local") {
+		vids = append(vids, services.ItemInfo(it))
+	}
+	return vids, nil
+}
+
+// record stores the metadata of id in the library once one of its files has
+// been written. Nothing is written if the files of id did not change.
+func (s *localService) record(ctx context.Context, id string) {
+	if s.library.Current(s.cache, "local", Key(id)) {
+		return
+	}
+
+	it, ok := s.library.Get("local", Key(id))
+	if !ok {
+		var err error
+		it, err = s.item(ctx, id)
+		if err != nil {
+			log.Printf("failed to retrieve library metadata: %v", err)
+			return
+		}
+		it.Downloaded = time.Now()
+	}
+
+	if _, err := s.library.Add(s.cache, it); err != nil {
+		log.Printf("failed to record library item: %v", err)
+	}
+}
+
+// Update changes the stored metadata of a downloaded file.
+func (s *localService) Update(ctx context.Context, id string, e services.Edit) (library.Item, error) {
+	return services.Update(s.library, s.cache, "local", Key(id), e)
+}
+
+// Remove deletes the named files of a file, or all of them along with its
+// library entry.
+func (s *localService) Remove(ctx context.Context, id string, names ...string) error {
+	return services.Remove(s.library, s.cache, "local", Key(id), names...)
+}
+
+// Cache returns the cache holding the files of the service.
+func (s *localService) Cache() *cache.Cache {
+	return s.cache
+}
+
+// Reindex rebuilds the library entries of all converted files. Files without
+// stored metadata are probed again if they still exist.
+func (s *localService) Reindex(ctx context.Context) error {
+	ids := make(map[string]string)
+	if err := s.walk(func(id string) error {
+		ids[Key(id)] = id
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read media files: %v", err)
+	}
+
+	items, err := library.Scan("local", s.cache, func(key string) (library.Item, error) {
+		id, ok := ids[key]
+		if !ok {
+			return library.Item{}, errors.New("media file does not exist anymore")
+		}
+		return s.item(ctx, id)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan converted files: %v", err)
+	}
+	return s.library.Replace("local", items)
+}
+
+// walk calls fn with the id of every media file below the root directory.
+func (s *localService) walk(fn func(id string) error) error {
+	return filepath.Walk(s.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !extensions[strings.ToLower(filepath.Ext(p))] || !s.inside(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+// path returns the location of the file id, which must not leave the root
+// directory.
+func (s *localService) path(id string) (string, error) {
+	clean := path.Clean("/" + id)
+	if id == "" || clean != "/"+id {
+		return "", fmt.Errorf("invalid media path: %s", id)
+	}
+	if !extensions[strings.ToLower(path.Ext(id))] {
+		return "", fmt.Errorf("unsupported media file: %s", id)
+	}
+
+	p := filepath.Join(s.root, filepath.FromSlash(id))
+	if fi, err := os.Stat(p); err != nil || fi.IsDir() || !s.inside(p) {
+		return "", fmt.Errorf("media file not found: %s", id)
+	}
+	return p, nil
+}
+
+// inside reports whether p is located below the root directory once all
+// symbolic links are resolved.
+func (s *localService) inside(p string) bool {
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// name derives the title of a media file without metadata from its path.
+func name(id string) string {
+	return strings.TrimSuffix(path.Base(id), path.Ext(id))
+}
+
+// Key returns the stable cache key of a media file.
+func Key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/services"
+)
+
+func TestSymlinkEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "media")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{filepath.Join(root, "inside.mp3"), filepath.Join(outside, "secret.mp3")} {
+		if err := ioutil.WriteFile(p, []byte("audio"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(outside, "secret.mp3"): filepath.Join(root, "secret.mp3"),
+		outside:                              filepath.Join(root, "outside"),
+		filepath.Join(root, "inside.mp3"):    filepath.Join(root, "link.mp3"),
+	}
+	for target, link := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib, err := library.Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(root, cache.New(filepath.Join(dir, "cache")), lib, 1, progress.NewBroker()).(*localService)
+
+	for _, id := range []string{"secret.mp3", "outside/secret.mp3"} {
+		if _, err := s.path(id); err == nil {
+			t.Errorf("got path of %s outside the root directory", id)
+		}
+	}
+	if _, err := s.path("link.mp3"); err != nil {
+		t.Errorf("link within the root directory was rejected: %v", err)
+	}
+
+	res, err := s.Search(context.Background(), services.Query{PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, vi := range res.Items {
+		titles = append(titles, vi.Title)
+	}
+	if len(titles) != 2 || titles[0] != "inside" || titles[1] != "link" {
+		t.Errorf("got files %v, want inside and link", titles)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+// Options select the variant of a file. The zero value selects the best
+// video quality and converts audio to mp3. Output is honoured by all services,
+// the stream selection only by those with the Options capability.
+type Options struct {
+	// MaxResolution limits the height of videos in lines, e.g. 720.
+	MaxResolution int `json:"max_resolution,omitempty"`
+	// Container is the preferred container of downloaded streams, e.g. mp4
+	// or webm. Audio is served in this container instead of as mp3. Videos
+	// are always served as mp4 and only accept mp4.
+	Container string `json:"container,omitempty"`
+	// Codec is the preferred audio codec, e.g. opus, vorbis or aac.
+	Codec string `json:"codec,omitempty"`
+	// AudioBitrate is the target audio bitrate in kbit/s.
+	AudioBitrate int `json:"audio_bitrate,omitempty"`
+	// Output is the encoding of converted audio files.
+	Output multimedia.Spec `json:"output"`
+	// Clip limits files to a time range.
+	Clip multimedia.Range `json:"clip"`
+	// Chapter selects a chapter of audio files, counted from 1. Chapters are
+	// stored apart from the other variants.
+	Chapter int `json:"chapter,omitempty"`
+	// Subtitles lists the languages of subtitles added to videos.
+	Subtitles []string `json:"subtitles,omitempty"`
+	// BurnSubtitles is the language of subtitles rendered into videos.
+	BurnSubtitles string `json:"burn_subtitles,omitempty"`
+}
+
+// IsZero reports whether the default variant is selected.
+func (o Options) IsZero() bool {
+	return o.Variant() == ""
+}
+
+// Selection returns the options without the output encoding.
+func (o Options) Selection() Options {
+	o.Output = multimedia.Spec{}
+	return o
+}
+
+// Unclipped returns the options selecting the whole file instead of a clip
+// or chapter.
+func (o Options) Unclipped() Options {
+	o.Clip = multimedia.Range{}
+	o.Chapter = 0
+	return o
+}
+
+// Validate checks that the options can be part of a file name.
+func (o Options) Validate() error {
+	if o.MaxResolution < 0 || o.AudioBitrate < 0 {
+		return errors.New("resolution and bitrate must not be negative")
+	}
+	if o.Container != "" && !o.Output.IsZero() {
+		return errors.New("audio is either served in its container or converted")
+	}
+	if err := o.Output.Validate(); err != nil {
+		return err
+	}
+	if err := o.Clip.Validate(); err != nil {
+		return err
+	}
+	if o.Chapter < 0 {
+		return errors.New("chapter must not be negative")
+	}
+	if o.Chapter > 0 && !o.Clip.IsZero() {
+		return errors.New("either a clip or a chapter may be selected")
+	}
+	for _, v := range []string{o.Container, o.Codec} {
+		for _, r := range v {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+				return fmt.Errorf("invalid container or codec: %q", v)
+			}
+		}
+	}
+	for _, lang := range o.Subtitles {
+		if err := ValidateLanguage(lang); err != nil {
+			return err
+		}
+	}
+	if o.BurnSubtitles != "" {
+		return ValidateLanguage(o.BurnSubtitles)
+	}
+	return nil
+}
+
+// ValidateVideo checks that the options can be used for video files, which
+// are always served as mp4.
+func (o Options) ValidateVideo() error {
+	if o.Container != "" && o.Container != "mp4" {
+		return fmt.Errorf("videos are only served as mp4, not %s", o.Container)
+	}
+	return nil
+}
+
+// Variant names the files produced with the options. It is empty for the
+// default variant.
+func (o Options) Variant() string {
+	var parts []string
+	if o.MaxResolution > 0 {
+		parts = append(parts, strconv.Itoa(o.MaxResolution)+"p")
+	}
+	if o.Container != "" {
+		parts = append(parts, o.Container)
+	}
+	if o.Codec != "" {
+		parts = append(parts, o.Codec)
+	}
+	if o.AudioBitrate > 0 {
+		parts = append(parts, strconv.Itoa(o.AudioBitrate)+"k")
+	}
+	if k := o.Output.Key(); k != "" {
+		parts = append(parts, k)
+	}
+	if len(o.Subtitles) > 0 {
+		parts = append(parts, "sub-"+strings.Join(o.Subtitles, "-"))
+	}
+	if o.BurnSubtitles != "" {
+		parts = append(parts, "burn-"+o.BurnSubtitles)
+	}
+	if k := o.Clip.Key(); k != "" {
+		parts = append(parts, k)
+	}
+	return strings.Join(parts, "-")
+}
+
+// Name returns the artifact name of the variant of a file called base with
+// the extension ext.
+func (o Options) Name(base, ext string) string {
+	if v := o.Variant(); v != "" {
+		return base + "-" + v + "." + ext
+	}
+	return base + "." + ext
+}
+
+// AudioExtension returns the extension of audio files produced with the
+// options.
+func (o Options) AudioExtension() string {
+	if o.Container != "" {
+		return o.Container
+	}
+	return o.Output.Extension()
+}
+
+// ValidateLanguage checks that lang looks like a language code, e.g. en or
+// pt-BR, so it can be part of a file name.
+func ValidateLanguage(lang string) error {
+	if lang == "" || len(lang) > 16 {
+		return fmt.Errorf("invalid language: %q", lang)
+	}
+	for _, r := range lang {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("invalid language: %q", lang)
+		}
+	}
+	return nil
+}
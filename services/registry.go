@@ -0,0 +1,92 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/progress"
+)
+
+// Env contains the facilities shared by all services.
+type Env struct {
+	Library *library.Store
+	Events  *progress.Broker
+}
+
+// Factory creates a service from its configuration block.
+type Factory func(config json.RawMessage, env Env) (Service, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a service provider available under the given name. It is
+// meant to be called from the init function of the provider and panics if
+// the name is already taken.
+func Register(name string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic("services: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// Open creates the service registered under name using its configuration
+// block.
+func Open(name string, config json.RawMessage, env Env) (Service, error) {
+	factoriesMu.Lock()
+	f, ok := factories[name]
+	factoriesMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown service: %q", name)
+	}
+
+	s, err := f(config, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open service %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// Registry holds the enabled services by name.
+type Registry struct {
+	services map[string]Service
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{services: make(map[string]Service)}
+}
+
+// Add enables a service under the given name.
+func (r *Registry) Add(name string, s Service) {
+	r.services[name] = s
+}
+
+// Get returns the service enabled under name.
+func (r *Registry) Get(name string) (Service, bool) {
+	s, ok := r.services[name]
+	return s, ok
+}
+
+// Names returns the names of all enabled services in alphabetical order.
+func (r *Registry) Names() []string {
+	var names []string
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
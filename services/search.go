@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Duration filters of a search, following the categories of YouTube.
+const (
+	ShortDuration  = "short"  // less than four minutes
+	MediumDuration = "medium" // between four and twenty minutes
+	LongDuration   = "long"   // more than twenty minutes
+)
+
+// Orders of search results.
+const (
+	OrderRelevance = "relevance"
+	OrderDate      = "date"
+	OrderTitle     = "title"
+	OrderViewCount = "viewCount"
+	OrderRating    = "rating"
+)
+
+// DefaultPageSize is the number of search results returned if the query does
+// not specify a page size.
+const DefaultPageSize = 10
+
+// MaxPageSize is the maximum number of search results per page.
+const MaxPageSize = 50
+
+// Query describes a search. Empty fields do not restrict the results.
+type Query struct {
+	Text      string
+	PageToken string
+	PageSize  int
+	Duration  string
+	After     time.Time // published after
+	Before    time.Time // published before
+	Order     string
+	Channel   string
+}
+
+// Validate checks the filters of the query and applies the default page
+// size.
+func (q *Query) Validate() error {
+	switch q.Duration {
+	case "", ShortDuration, MediumDuration, LongDuration:
+	default:
+		return fmt.Errorf("unknown duration: %q", q.Duration)
+	}
+
+	switch q.Order {
+	case "", OrderRelevance, OrderDate, OrderTitle, OrderViewCount, OrderRating:
+	default:
+		return fmt.Errorf("unknown order: %q", q.Order)
+	}
+
+	if q.PageSize == 0 {
+		q.PageSize = DefaultPageSize
+	}
+	if q.PageSize < 0 || q.PageSize > MaxPageSize {
+		return fmt.Errorf("page size must be between 1 and %d", MaxPageSize)
+	}
+
+	if !q.After.IsZero() && !q.Before.IsZero() && q.Before.Before(q.After) {
+		return errors.New("published before must not be earlier than published after")
+	}
+	return nil
+}
+
+// MatchDuration reports whether a video of duration d passes the duration
+// filter.
+func (q Query) MatchDuration(d time.Duration) bool {
+	switch q.Duration {
+	case ShortDuration:
+		return d < 4*time.Minute
+	case MediumDuration:
+		return d >= 4*time.Minute && d <= 20*time.Minute
+	case LongDuration:
+		return d > 20*time.Minute
+	}
+	return true
+}
+
+// MatchPublished reports whether a video published at t passes the date
+// filters.
+func (q Query) MatchPublished(t time.Time) bool {
+	if !q.After.IsZero() && t.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && t.After(q.Before) {
+		return false
+	}
+	return true
+}
+
+// SearchResult is a page of search results.
+type SearchResult struct {
+	Items []VideoInfo `json:"items"`
+	// NextPageToken selects the following page, it is empty on the last
+	// page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+	PageSize      int    `json:"page_size"`
+	// TotalResults is an estimate of the number of results.
+	TotalResults int `json:"total_results"`
+}
@@ -7,22 +7,177 @@ package services
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/transcript"
 )
 
+// ErrNotSupported is returned by services for operations they do not offer.
+var ErrNotSupported = errors.New("operation not supported by service")
+
+// Capabilities describes which operations a service offers.
+type Capabilities struct {
+	Search bool `json:"search"`
+	Audio  bool `json:"audio"`
+	Video  bool `json:"video"`
+	// Options is set if the service honours Options, others only produce
+	// the default variant.
+	Options bool `json:"options"`
+	// Playlists is set if the service implements Playlister.
+	Playlists bool `json:"playlists"`
+	// Subscriptions is set if the service implements Subscriber.
+	Subscriptions bool `json:"subscriptions"`
+	// Subtitles is set if the service implements Subtitler and adds
+	// subtitles to videos.
+	Subtitles bool `json:"subtitles"`
+	// Transcripts is set if the service implements Transcriber.
+	Transcripts bool `json:"transcripts"`
+	// Manage is set if the service implements Curator.
+	Manage bool `json:"manage"`
+}
+
 // Service describes an interface for interacting with a video service.
 type Service interface {
-	Search(ctx context.Context, query string) ([]string, error)
+	Capabilities() Capabilities
+	Search(ctx context.Context, q Query) (SearchResult, error)
 	Info(ctx context.Context, id string) (VideoInfo, error)
-	AudioFile(ctx context.Context, id string) (io.ReadCloser, error)
-	VideoFile(ctx context.Context, id string) (io.ReadCloser, error)
+	AudioFile(ctx context.Context, id string, opts Options) (io.ReadCloser, error)
+	VideoFile(ctx context.Context, id string, opts Options) (io.ReadCloser, error)
 	List(ctx context.Context) ([]VideoInfo, error)
 }
 
+// Indexer is implemented by services which are able to rebuild their library
+// entries from the files on disk.
+type Indexer interface {
+	Reindex(ctx context.Context) error
+}
+
+// Storer is implemented by services keeping their files in a cache. The
+// files are subject to the retention policy.
+type Storer interface {
+	Cache() *cache.Cache
+}
+
+// Sources of uploads offered by a Subscriber.
+const (
+	ChannelSource  = "channel"
+	PlaylistSource = "playlist"
+)
+
+// Upload is a video published in a channel or playlist.
+type Upload struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title"`
+	Published time.Time     `json:"published"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Subscriber is implemented by services which are able to list the videos
+// of a channel or playlist. Uploads returns the most recently published or
+// added videos, newest first.
+type Subscriber interface {
+	Uploads(ctx context.Context, source, id string, max int) ([]Upload, error)
+}
+
+// Playlister is implemented by services which are able to expand playlists
+// into their videos.
+type Playlister interface {
+	Playlist(ctx context.Context, id string) ([]Upload, error)
+}
+
+// ErrNoSubtitle is returned for subtitles a video does not have.
+var ErrNoSubtitle = errors.New("subtitle not found")
+
+// Subtitle formats offered by Subtitler.
+const (
+	SRT    = "srt"
+	WebVTT = "vtt"
+)
+
+// Subtitle is a subtitle track of a video.
+type Subtitle struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	// Auto is set for automatically generated subtitles.
+	Auto bool `json:"auto"`
+}
+
+// Subtitler is implemented by services offering the subtitles of videos.
+type Subtitler interface {
+	// Subtitles lists the subtitle tracks of a video.
+	Subtitles(ctx context.Context, id string) ([]Subtitle, error)
+	// SubtitleFile returns the subtitle of a video in the given language
+	// and format, either SRT or WebVTT.
+	SubtitleFile(ctx context.Context, id, lang, format string) (io.ReadCloser, error)
+}
+
+// Transcriber is implemented by services creating transcripts from subtitles.
+type Transcriber interface {
+	// Transcript returns the transcript of a video in the given language and
+	// stores its text in the library.
+	Transcript(ctx context.Context, id, lang string) (transcript.Transcript, error)
+}
+
+// VideoInfo describes a video of a service.
 type VideoInfo struct {
-	ID        string `json:"id"`
-	Title     string `json:"title"`
-	URL       string `json:"url"`
-	Thumbnail string `json:"thumbnail"`
-	Service   string `json:"service"`
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Thumbnail   string    `json:"thumbnail"`
+	Service     string    `json:"service"`
+	Channel     string    `json:"channel"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Language    string    `json:"language"`
+	Duration    int64     `json:"duration"` // in seconds
+	Published   time.Time `json:"published"`
+	// Chapters are the chapters listed in the description.
+	Chapters []multimedia.Chapter `json:"chapters,omitempty"`
+	// Subtitles lists the languages of the subtitles of the video.
+	Subtitles []string `json:"subtitles,omitempty"`
+	// Formats lists the formats offered for download by the service.
+	Formats []Format `json:"formats,omitempty"`
+	// Artifacts lists the files of the video which are cached already.
+	Artifacts []library.File `json:"artifacts"`
+}
+
+// Format is a downloadable format of a video.
+type Format struct {
+	ID           string `json:"id"`
+	Extension    string `json:"extension"`
+	Resolution   string `json:"resolution,omitempty"`
+	VideoCodec   string `json:"video_codec,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	Bitrate      int64  `json:"bitrate,omitempty"`       // in bit/s
+	AudioBitrate int    `json:"audio_bitrate,omitempty"` // in kbit/s
+	// Size is an estimate in bytes, it is zero if unknown.
+	Size int64 `json:"size,omitempty"`
+}
+
+// ItemInfo returns the video info of a library item.
+func ItemInfo(it library.Item) VideoInfo {
+	return VideoInfo{
+		ID:          it.VideoID(),
+		Title:       it.Title,
+		URL:         it.URL,
+		Thumbnail:   it.Thumbnail,
+		Service:     it.Service,
+		Channel:     it.Channel,
+		Description: it.Description,
+		Tags:        it.Tags,
+		Duration:    it.Duration,
+		Published:   it.Published,
+		Chapters:    Chapters(it),
+		Artifacts:   it.Files,
+	}
+}
+
+// Chapters returns the chapters listed in the description of a library item.
+func Chapters(it library.Item) []multimedia.Chapter {
+	return multimedia.ParseChapters(it.Description, time.Duration(it.Duration)*time.Second)
 }
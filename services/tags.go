@@ -0,0 +1,151 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+// maxCover is the maximum size of downloaded cover art.
+const maxCover = 5 << 20
+
+// Retagger is implemented by services which are able to rewrite the tags of
+// cached files, e.g. after the metadata of an item changed.
+type Retagger interface {
+	Retag(ctx context.Context, id string) error
+}
+
+// Tags returns the tags of a library item, including the chapters listed in
+// its description. Its thumbnail is downloaded as cover art, files are tagged
+// without cover if this fails.
+func Tags(ctx context.Context, it library.Item) multimedia.Tags {
+	tags := multimedia.Tags{
+		Title:   it.Title,
+		Artist:  it.Channel,
+		Album:   it.Channel,
+		Comment: it.URL,
+		Genre:   "Podcast",
+	}
+	if !it.Published.IsZero() {
+		tags.Date = it.Published.Format("2006-01-02")
+	}
+	tags.Chapters = Chapters(it)
+
+	if it.Thumbnail != "" {
+		cover, err := download(ctx, it.Thumbnail)
+		if err != nil {
+			log.Printf("failed to download cover art: %v", err)
+		}
+		tags.Cover = cover
+	}
+	return tags
+}
+
+func download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCover))
+}
+
+var (
+	// chapterName matches the names of chapter files, e.g. chapter-3.mp3.
+	chapterName = regexp.MustCompile(`^chapter-(\d+)(-|$)`)
+	// clipName matches the names of clips, which end in their range, e.g.
+	// audio-90s-150s.mp3.
+	clipName = regexp.MustCompile(`-\d+m?s-(\d+m?s)?$`)
+)
+
+// Tagged reports whether the named artifact is delivered to clients and
+// carries tags. Downloaded streams, named after their itag, are not tagged.
+func Tagged(name string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if !multimedia.CanTag(ext) {
+		return false
+	}
+	if chapterName.MatchString(base) {
+		return true
+	}
+
+	for _, prefix := range []string{"audio", "combined"} {
+		if base == prefix {
+			return true
+		}
+		if v := strings.TrimPrefix(base, prefix+"-"); v != base {
+			return strings.Trim(v, "0123456789") != ""
+		}
+	}
+	return false
+}
+
+// fileTags returns the tags of the named artifact of a video tagged with
+// tags. Chapters and clips are tagged like ChapterFile and Clip do.
+func fileTags(name string, tags multimedia.Tags) (multimedia.Tags, error) {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if m := chapterName.FindStringSubmatch(base); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return chapterTags(tags, n)
+	}
+	if clipName.MatchString(base) {
+		return clipTags(tags), nil
+	}
+	return tags, nil
+}
+
+// Retag rewrites the tags of all tagged files of key stored in c. Chapters
+// which are no longer listed in the description keep their tags.
+func Retag(ctx context.Context, c *cache.Cache, conv multimedia.Converter, key string, tags multimedia.Tags) error {
+	files, err := library.Files(c, key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !Tagged(f.Name) {
+			continue
+		}
+
+		t, err := fileTags(f.Name, tags)
+		if err != nil {
+			log.Printf("not retagging %s of %s: %v", f.Name, key, err)
+			continue
+		}
+
+		ext := strings.TrimPrefix(path.Ext(f.Name), ".")
+		err = c.Rewrite(ctx, key, f.Name, func(ctx context.Context, r io.Reader, w io.Writer) error {
+			return conv.Tag(ctx, r, w, ext, t)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to retag %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
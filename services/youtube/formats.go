@@ -0,0 +1,145 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package youtube
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rylio/ytdl"
+	"kohlbau.de/x/jaye/services"
+)
+
+// formats describes the formats of vid.
+func formats(vid *ytdl.VideoInfo) []services.Format {
+	var fms []services.Format
+	for _, fm := range vid.Formats {
+		bitrate := metaInt(fm, "bitrate")
+		fms = append(fms, services.Format{
+			ID:           strconv.Itoa(fm.Itag),
+			Extension:    fm.Extension,
+			Resolution:   fm.Resolution,
+			VideoCodec:   fm.VideoEncoding,
+			AudioCodec:   fm.AudioEncoding,
+			Bitrate:      bitrate,
+			AudioBitrate: fm.AudioBitrate,
+			Size:         size(fm, bitrate, vid.Duration),
+		})
+	}
+	return fms
+}
+
+// size returns the content length of fm, which is only known for adaptive
+// formats. Otherwise it is estimated from the bitrate.
+func size(fm ytdl.Format, bitrate int64, d time.Duration) int64 {
+	if n := metaInt(fm, "clen"); n > 0 {
+		return n
+	}
+	if bitrate == 0 {
+		bitrate = int64(fm.AudioBitrate) * 1000
+	}
+	return bitrate / 8 * int64(d/time.Second)
+}
+
+// metaInt returns the numeric value of a format key which is not exposed by
+// ytdl directly, or zero if it is missing.
+func metaInt(fm ytdl.Format, key ytdl.FormatKey) int64 {
+	v := fm.ValueForKey(key)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	return n
+}
+
+// selectVideo returns the video stream with the highest resolution allowed by
+// opts.
+func selectVideo(fms ytdl.FormatList, opts services.Options) (ytdl.Format, error) {
+	var list ytdl.FormatList
+	for _, fm := range fms {
+		if fm.Resolution == "" {
+			continue
+		}
+		if opts.MaxResolution > 0 && height(fm.Resolution) > opts.MaxResolution {
+			continue
+		}
+		if opts.Container != "" && fm.Extension != opts.Container {
+			continue
+		}
+		list = append(list, fm)
+	}
+	if len(list) == 0 {
+		return ytdl.Format{}, errors.New("no video format matches the options")
+	}
+
+	return list.Best(ytdl.FormatResolutionKey)[0], nil
+}
+
+// selectAudio returns the audio stream of the given container and codec with
+// the highest bitrate not exceeding the target bitrate. If all streams exceed
+// it the one with the lowest bitrate is used. Empty values match all streams.
+func selectAudio(fms ytdl.FormatList, container, codec string, bitrate int) (ytdl.Format, error) {
+	var list ytdl.FormatList
+	for _, fm := range fms {
+		if fm.AudioEncoding == "" {
+			continue
+		}
+		if container != "" && fm.Extension != extension(container) {
+			continue
+		}
+		if codec != "" && fm.AudioEncoding != codec {
+			continue
+		}
+		list = append(list, fm)
+	}
+	if len(list) == 0 {
+		return ytdl.Format{}, errors.New("no audio format matches the options")
+	}
+
+	if bitrate > 0 {
+		var below ytdl.FormatList
+		for _, fm := range list {
+			// zero means the bitrate is unknown
+			if fm.AudioBitrate > 0 && fm.AudioBitrate <= bitrate {
+				below = append(below, fm)
+			}
+		}
+		if len(below) == 0 {
+			below = list.Worst(ytdl.FormatAudioBitrateKey)
+		}
+		list = below
+	}
+
+	// streams without video are smaller
+	best := list.Best(ytdl.FormatAudioBitrateKey)
+	for _, fm := range best {
+		if fm.Resolution == "" {
+			return fm, nil
+		}
+	}
+	return best[0], nil
+}
+
+// extension returns the extension ytdl uses for streams of a container.
+func extension(container string) string {
+	// audio streams in mp4 containers are commonly known as m4a
+	if container == "m4a" {
+		return "mp4"
+	}
+	return container
+}
+
+// height returns the number of lines of a resolution such as 720p.
+func height(res string) int {
+	i := 0
+	for i < len(res) && res[i] >= '0' && res[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(res[:i])
+	return n
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package youtube
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/services"
+	"kohlbau.de/x/jaye/transcript"
+)
+
+const (
+	// defaultTimedTextURL is the endpoint serving the subtitles of videos.
+	defaultTimedTextURL = "https://www.youtube.com/api/timedtext"
+	// maxSubtitle is the maximum size of a downloaded subtitle.
+	maxSubtitle = 10 << 20
+)
+
+// Subtitles lists the subtitle tracks of a video using the Data API.
+func (s *youtubeService) Subtitles(ctx context.Context, id string) ([]services.Subtitle, error) {
+	q := url.Values{}
+	q.Set("part", "snippet")
+	q.Set("videoId", id)
+
+	var cs captions
+	if err := s.get(ctx, "captions", q, &cs); err != nil {
+		return nil, err
+	}
+
+	subs := []services.Subtitle{}
+	for _, c := range cs.Items {
+		subs = append(subs, services.Subtitle{
+			Language: c.Snippet.Language,
+			Name:     c.Snippet.Name,
+			Auto:     strings.EqualFold(c.Snippet.TrackKind, "asr"),
+		})
+	}
+	return subs, nil
+}
+
+// SubtitleFile returns the subtitle of id in lang, which is stored next to the
+// files of the video.
+func (s *youtubeService) SubtitleFile(ctx context.Context, id, lang, format string) (io.ReadCloser, error) {
+	p, err := s.subtitleFile(ctx, id, lang, format)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *youtubeService) subtitleFile(ctx context.Context, id, lang, format string) (string, error) {
+	if err := services.ValidateLanguage(lang); err != nil {
+		return "", err
+	}
+
+	switch format {
+	case services.WebVTT:
+		return s.subtitle(ctx, id, lang)
+	case services.SRT:
+		return s.cache.Artifact(ctx, id, "subtitles-"+lang+".srt", cache.Subtitles, func(ctx context.Context, w io.Writer) error {
+			p, err := s.subtitle(ctx, id, lang)
+			if err != nil {
+				return err
+			}
+
+			vtt, err := ioutil.ReadFile(p)
+			if err != nil {
+				return fmt.Errorf("failed to read subtitle: %v", err)
+			}
+			return multimedia.WriteSRT(w, vtt)
+		})
+	}
+	return "", fmt.Errorf("unsupported subtitle format: %q", format)
+}
+
+// subtitle downloads the WebVTT subtitle of id in lang. Automatically
+// generated subtitles are used if there is no regular one.
+func (s *youtubeService) subtitle(ctx context.Context, id, lang string) (string, error) {
+	return s.cache.Artifact(ctx, id, "subtitles-"+lang+".vtt", cache.Subtitles, func(ctx context.Context, w io.Writer) error {
+		for _, kind := range []string{"", "asr"} {
+			vtt, err := s.timedText(ctx, id, lang, kind)
+			if err != nil {
+				return err
+			}
+			// missing subtitles result in an empty response
+			if bytes.Contains(vtt, []byte("-->")) {
+				_, err := w.Write(vtt)
+				return err
+			}
+		}
+		return services.ErrNoSubtitle
+	})
+}
+
+// Transcript creates the transcript of id from its subtitle in lang, split
+// at the chapters of the video. Its text is stored with the library item of
+// downloaded videos to make it searchable.
+func (s *youtubeService) Transcript(ctx context.Context, id, lang string) (transcript.Transcript, error) {
+	p, err := s.subtitleFile(ctx, id, lang, services.WebVTT)
+	if err != nil {
+		return transcript.Transcript{}, err
+	}
+
+	vtt, err := ioutil.ReadFile(p)
+	if err != nil {
+		return transcript.Transcript{}, fmt.Errorf("failed to read subtitle: %v", err)
+	}
+
+	it, err := s.libraryItem(id)(ctx)
+	if err != nil {
+		return transcript.Transcript{}, err
+	}
+
+	t := transcript.New(lang, transcript.Parse(vtt), services.Chapters(it))
+
+	_, err = s.library.Modify(s.cache, "youtube", id, func(it *library.Item) {
+		// the map is shared with the stored item
+		ts := map[string]string{lang: t.Text()}
+		for l, text := range it.Transcripts {
+			if l != lang {
+				ts[l] = text
+			}
+		}
+		it.Transcripts = ts
+	})
+	if err != nil && err != library.ErrNotFound {
+		log.Printf("failed to record library item: %v", err)
+	}
+
+	return t, nil
+}
+
+// subtitles returns the subtitles of id selected by opts for merging.
+func (s *youtubeService) subtitles(ctx context.Context, id string, opts services.Options) ([]multimedia.Subtitle, error) {
+	var subs []multimedia.Subtitle
+	add := func(lang string, burn bool) error {
+		p, err := s.subtitle(ctx, id, lang)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s subtitles: %v", lang, err)
+		}
+
+		vtt, err := ioutil.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to read subtitle: %v", err)
+		}
+		subs = append(subs, multimedia.Subtitle{Language: lang, Data: vtt, Burn: burn})
+		return nil
+	}
+
+	for _, lang := range opts.Subtitles {
+		if err := add(lang, false); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BurnSubtitles != "" {
+		if err := add(opts.BurnSubtitles, true); err != nil {
+			return nil, err
+		}
+	}
+	return subs, nil
+}
+
+// timedText downloads the WebVTT subtitle of id in lang, kind is asr for
+// automatically generated subtitles.
+func (s *youtubeService) timedText(ctx context.Context, id, lang, kind string) ([]byte, error) {
+	q := url.Values{}
+	q.Set("v", id)
+	q.Set("lang", lang)
+	q.Set("fmt", "vtt")
+	if kind != "" {
+		q.Set("kind", kind)
+	}
+
+	req, err := http.NewRequest("GET", s.timedTextURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := s.cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download subtitle: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to download subtitle: invalid status code: %d", resp.StatusCode)
+	}
+
+	vtt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSubtitle))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download subtitle: %v", err)
+	}
+	return vtt, nil
+}
+
+type captions struct {
+	Items []struct {
+		ID      string `json:"id"`
+		Snippet struct {
+			VideoID   string `json:"videoId"`
+			TrackKind string `json:"trackKind"`
+			Language  string `json:"language"`
+			Name      string `json:"name"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
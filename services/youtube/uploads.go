@@ -0,0 +1,323 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package youtube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/services"
+)
+
+const (
+	// pageSize is the maximum number of results the Data API returns per page.
+	pageSize = 50
+	// maxPlaylist is the maximum number of videos a playlist is expanded to.
+	maxPlaylist = 5000
+)
+
+// Uploads returns up to max videos of a channel or playlist, newest first.
+// Videos are ordered by the time they were added, so the whole playlist is
+// looked up as videos may be added at any position. This only happens once
+// the playlist changed.
+func (s *youtubeService) Uploads(ctx context.Context, source, id string, max int) ([]services.Upload, error) {
+	var uploads []services.Upload
+	switch source {
+	case services.PlaylistSource:
+		var err error
+		uploads, err = s.playlistUploads(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	case services.ChannelSource:
+		// the uploads playlist of a channel lists the newest videos first
+		playlist, err := s.uploadsPlaylist(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		uploads, err = s.playlistItems(ctx, playlist, max)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown source: %q", source)
+	}
+
+	sort.SliceStable(uploads, func(i, j int) bool { return uploads[i].Published.After(uploads[j].Published) })
+	if len(uploads) > max {
+		uploads = uploads[:max]
+	}
+
+	if err := s.durations(ctx, uploads); err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
+
+// Playlist returns the videos of a playlist in their playlist order.
+func (s *youtubeService) Playlist(ctx context.Context, id string) ([]services.Upload, error) {
+	return s.playlistItems(ctx, id, maxPlaylist)
+}
+
+// playlistUploads holds the videos of a playlist along with the ETag of the
+// playlist they were looked up for.
+type playlistUploads struct {
+	etag    string
+	uploads []services.Upload
+}
+
+// playlistUploads returns the videos of a playlist. The videos are only
+// looked up again if the ETag of the playlist, which changes along with its
+// number of videos, differs from the one of the last lookup.
+func (s *youtubeService) playlistUploads(ctx context.Context, id string) ([]services.Upload, error) {
+	s.m.Lock()
+	last, ok := s.playlists[id]
+	s.m.Unlock()
+
+	q := url.Values{}
+	q.Set("part", "contentDetails")
+	q.Set("id", id)
+
+	var pl playlists
+	err := s.request(ctx, "playlists", q, last.etag, &pl)
+	if err == errNotModified {
+		return append([]services.Upload(nil), last.uploads...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pl.Items) == 0 {
+		return nil, fmt.Errorf("failed to find playlist for id: %s", id)
+	}
+	etag := pl.Items[0].ETag
+	if ok && etag == last.etag {
+		return append([]services.Upload(nil), last.uploads...), nil
+	}
+
+	uploads, err := s.playlistItems(ctx, id, maxPlaylist)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	s.playlists[id] = playlistUploads{etag: etag, uploads: uploads}
+	s.m.Unlock()
+
+	return append([]services.Upload(nil), uploads...), nil
+}
+
+// errNotModified is returned by request if the resource did not change.
+var errNotModified = errors.New("resource not modified")
+
+// get queries the given endpoint of the Data API and decodes the response
+// into v.
+func (s *youtubeService) get(ctx context.Context, endpoint string, q url.Values, v interface{}) error {
+	return s.request(ctx, endpoint, q, "", v)
+}
+
+// request is like get. If etag is set, the request is conditional and
+// errNotModified is returned if the resource still has the given ETag.
+func (s *youtubeService) request(ctx context.Context, endpoint string, q url.Values, etag string, v interface{}) error {
+	q.Set("key", s.youtubeToken)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/?%s", s.youtubeURL, endpoint, q.Encode()), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	req = req.WithContext(ctx)
+	resp, err := s.cl.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query youtube api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to query youtube api: invalid status code: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", endpoint, err)
+	}
+	return nil
+}
+
+// uploadsPlaylist returns the id of the playlist holding all uploads of a
+// channel.
+func (s *youtubeService) uploadsPlaylist(ctx context.Context, channel string) (string, error) {
+	q := url.Values{}
+	q.Set("part", "contentDetails")
+	q.Set("id", channel)
+
+	var ch channels
+	if err := s.get(ctx, "channels", q, &ch); err != nil {
+		return "", err
+	}
+	if len(ch.Items) == 0 {
+		return "", fmt.Errorf("failed to find channel for id: %s", channel)
+	}
+
+	return ch.Items[0].ContentDetails.RelatedPlaylists.Uploads, nil
+}
+
+// playlistItems returns up to max videos of a playlist, following the page
+// tokens of the Data API.
+func (s *youtubeService) playlistItems(ctx context.Context, playlist string, max int) ([]services.Upload, error) {
+	var uploads []services.Upload
+	token := ""
+	for len(uploads) < max {
+		q := url.Values{}
+		q.Set("part", "snippet")
+		q.Set("playlistId", playlist)
+		q.Set("maxResults", strconv.Itoa(pageSize))
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+
+		var items playlistItems
+		if err := s.get(ctx, "playlistItems", q, &items); err != nil {
+			return nil, err
+		}
+
+		for _, it := range items.Items {
+			if len(uploads) == max {
+				break
+			}
+			uploads = append(uploads, services.Upload{
+				ID:        it.Snippet.ResourceID.VideoID,
+				Title:     it.Snippet.Title,
+				Published: it.Snippet.PublishedAt,
+			})
+		}
+
+		token = items.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+
+	return uploads, nil
+}
+
+// durations fills in the duration of the uploads.
+func (s *youtubeService) durations(ctx context.Context, uploads []services.Upload) error {
+	for i := 0; i < len(uploads); i += pageSize {
+		end := i + pageSize
+		if end > len(uploads) {
+			end = len(uploads)
+		}
+
+		var ids []string
+		for _, u := range uploads[i:end] {
+			ids = append(ids, u.ID)
+		}
+
+		q := url.Values{}
+		q.Set("part", "contentDetails")
+		q.Set("id", strings.Join(ids, ","))
+
+		var vids videoDetails
+		if err := s.get(ctx, "videos", q, &vids); err != nil {
+			return err
+		}
+
+		durations := make(map[string]time.Duration)
+		for _, v := range vids.Items {
+			durations[v.ID] = parseDuration(v.ContentDetails.Duration)
+		}
+		for j := i; j < end; j++ {
+			uploads[j].Duration = durations[uploads[j].ID]
+		}
+	}
+	return nil
+}
+
+var durationRegexp = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration parses the ISO 8601 durations used by the Data API, such as
+// PT1H2M3S. Invalid durations result in zero.
+func parseDuration(s string) time.Duration {
+	m := durationRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if n, err := strconv.Atoi(m[i+1]); err == nil {
+			d += time.Duration(n) * unit
+		}
+	}
+	return d
+}
+
+type channels struct {
+	Items []struct {
+		ID             string `json:"id"`
+		ContentDetails struct {
+			RelatedPlaylists struct {
+				Uploads string `json:"uploads"`
+			} `json:"relatedPlaylists"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
+
+type playlists struct {
+	Items []struct {
+		ETag           string `json:"etag"`
+		ID             string `json:"id"`
+		ContentDetails struct {
+			ItemCount int `json:"itemCount"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
+
+type playlistItems struct {
+	NextPageToken string `json:"nextPageToken"`
+	PageInfo      struct {
+		TotalResults   int `json:"totalResults"`
+		ResultsPerPage int `json:"resultsPerPage"`
+	} `json:"pageInfo"`
+	Items []struct {
+		ID      string `json:"id"`
+		Snippet struct {
+			PublishedAt  time.Time `json:"publishedAt"`
+			ChannelID    string    `json:"channelId"`
+			ChannelTitle string    `json:"channelTitle"`
+			Title        string    `json:"title"`
+			Description  string    `json:"description"`
+			Position     int       `json:"position"`
+			ResourceID   struct {
+				Kind    string `json:"kind"`
+				VideoID string `json:"videoId"`
+			} `json:"resourceId"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+type videoDetails struct {
+	Items []struct {
+		ID             string `json:"id"`
+		ContentDetails struct {
+			Duration string `json:"duration"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package youtube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kohlbau.de/x/jaye/services"
+)
+
+// item is a video of a fake playlist, added on the given day of 2017.
+type item struct {
+	id  string
+	day int
+}
+
+// dataAPI is a fake Data API serving playlists in pages of two items. The
+// ETag of a playlist is derived from its number of items.
+type dataAPI struct {
+	m         sync.Mutex
+	playlists map[string][]item
+	channels  map[string]string
+	pages     map[string]int
+}
+
+func (d *dataAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	q := r.URL.Query()
+	var v interface{}
+	switch strings.Trim(r.URL.Path, "/") {
+	case "playlists":
+		n := len(d.playlists[q.Get("id")])
+		etag := "etag-" + strconv.Itoa(n)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		v = map[string]interface{}{"items": []interface{}{map[string]interface{}{
+			"etag":           etag,
+			"id":             q.Get("id"),
+			"contentDetails": map[string]int{"itemCount": n},
+		}}}
+	case "channels":
+		v = map[string]interface{}{"items": []interface{}{map[string]interface{}{
+			"id":             q.Get("id"),
+			"contentDetails": map[string]interface{}{"relatedPlaylists": map[string]string{"uploads": d.channels[q.Get("id")]}},
+		}}}
+	case "playlistItems":
+		d.pages[q.Get("playlistId")]++
+
+		items := d.playlists[q.Get("playlistId")]
+		start, _ := strconv.Atoi(q.Get("pageToken"))
+		end := start + 2
+		next := strconv.Itoa(end)
+		if end >= len(items) {
+			end, next = len(items), ""
+		}
+
+		var page []interface{}
+		for _, it := range items[start:end] {
+			page = append(page, map[string]interface{}{"snippet": map[string]interface{}{
+				"title":       "Video " + it.id,
+				"publishedAt": time.Date(2017, 1, it.day, 0, 0, 0, 0, time.UTC),
+				"resourceId":  map[string]string{"videoId": it.id},
+			}})
+		}
+		v = map[string]interface{}{"items": page, "nextPageToken": next}
+	case "videos":
+		var vids []interface{}
+		for _, id := range strings.Split(q.Get("id"), ",") {
+			vids = append(vids, map[string]interface{}{
+				"id":             id,
+				"contentDetails": map[string]string{"duration": "PT1M30S"},
+			})
+		}
+		v = map[string]interface{}{"items": vids}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func newDataAPI(t *testing.T) (*dataAPI, *youtubeService) {
+	t.Helper()
+
+	d := &dataAPI{
+		playlists: map[string][]item{
+			// videos were added to the playlist at arbitrary positions
+			"PL1": {{"v1", 1}, {"v2", 3}, {"v3", 2}, {"v4", 5}, {"v5", 4}},
+			"UU1": {{"c3", 3}, {"c2", 2}, {"c1", 1}},
+		},
+		channels: map[string]string{"UC1": "UU1"},
+		pages:    make(map[string]int),
+	}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+
+	s := newTestService(t, 1, newFakeDownloader())
+	s.youtubeURL = srv.URL
+	return d, s
+}
+
+func ids(uploads []services.Upload) string {
+	var ids []string
+	for _, u := range uploads {
+		ids = append(ids, u.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestPlaylistUploads(t *testing.T) {
+	d, s := newDataAPI(t)
+
+	uploads, err := s.Uploads(context.Background(), services.PlaylistSource, "PL1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(uploads), "v4,v5,v2"; got != want {
+		t.Errorf("got uploads %s, want %s", got, want)
+	}
+	if d.pages["PL1"] != 3 {
+		t.Errorf("got %d pages requested, want 3", d.pages["PL1"])
+	}
+	for _, u := range uploads {
+		if u.Duration != 90*time.Second {
+			t.Errorf("got duration %v of %s, want 1m30s", u.Duration, u.ID)
+		}
+	}
+}
+
+func TestChannelUploads(t *testing.T) {
+	d, s := newDataAPI(t)
+
+	uploads, err := s.Uploads(context.Background(), services.ChannelSource, "UC1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(uploads), "c3,c2"; got != want {
+		t.Errorf("got uploads %s, want %s", got, want)
+	}
+	if d.pages["UU1"] != 1 {
+		t.Errorf("got %d pages requested, want 1", d.pages["UU1"])
+	}
+}
+
+func TestPlaylistUploadsUnchanged(t *testing.T) {
+	d, s := newDataAPI(t)
+
+	for i := 0; i < 2; i++ {
+		uploads, err := s.Uploads(context.Background(), services.PlaylistSource, "PL1", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(uploads), "v4,v5,v2"; got != want {
+			t.Errorf("got uploads %s, want %s", got, want)
+		}
+	}
+	// the playlist is only paged through once while it does not change
+	if d.pages["PL1"] != 3 {
+		t.Errorf("got %d pages requested, want 3", d.pages["PL1"])
+	}
+
+	d.m.Lock()
+	d.playlists["PL1"] = append(d.playlists["PL1"], item{"v6", 6})
+	d.m.Unlock()
+
+	uploads, err := s.Uploads(context.Background(), services.PlaylistSource, "PL1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(uploads), "v6,v4,v5"; got != want {
+		t.Errorf("got uploads %s, want %s", got, want)
+	}
+	if d.pages["PL1"] != 6 {
+		t.Errorf("got %d pages requested, want 6", d.pages["PL1"])
+	}
+}
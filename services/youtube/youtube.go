@@ -8,275 +8,598 @@ package youtube
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
-	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/rylio/ytdl"
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
 	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/progress"
 	"kohlbau.de/x/jaye/services"
 )
 
 type youtubeService struct {
-	m            sync.Mutex
 	youtubeURL   string
 	youtubeToken string
-	videoPath    string
+	timedTextURL string
+	cache        *cache.Cache
+	library      *library.Store
 	cl           http.Client
 	converter    multimedia.Converter
+	downloader   downloader
+	events       *progress.Broker
+	slots        chan struct{}
+
+	m sync.Mutex
+	// playlists remembers the uploads of subscribed playlists.
+	playlists map[string]playlistUploads
+}
+
+// downloader fetches the metadata and streams of videos.
+type downloader interface {
+	Info(id string) (*ytdl.VideoInfo, error)
+	Download(vid *ytdl.VideoInfo, fm ytdl.Format, w io.Writer) error
+}
+
+// ytdlDownloader fetches videos from YouTube.
+type ytdlDownloader struct{}
+
+func (ytdlDownloader) Info(id string) (*ytdl.VideoInfo, error) {
+	return ytdl.GetVideoInfoFromID(id)
+}
+
+func (ytdlDownloader) Download(vid *ytdl.VideoInfo, fm ytdl.Format, w io.Writer) error {
+	return vid.Download(fm, w)
+}
+
+// Config is the configuration block of the youtube service.
+type Config struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// TimedTextURL serves subtitles, it defaults to the endpoint of YouTube.
+	TimedTextURL string `json:"timedtext_url"`
+	VideoPath    string `json:"video_path"`
+	MaxParallel  int    `json:"max_parallel"`
 }
 
-func New(youtubeURL, youtubeToken, videoPath string) services.Service {
-	return youtubeService{
+func init() {
+	services.Register("youtube", open)
+}
+
+func open(raw json.RawMessage, env services.Env) (services.Service, error) {
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+
+	c := cache.New(cfg.VideoPath)
+	if err := c.Sweep(); err != nil {
+		return nil, err
+	}
+
+	return New(cfg.URL, cfg.Token, cfg.TimedTextURL, c, env.Library, cfg.MaxParallel, env.Events), nil
+}
+
+// New returns the youtube service storing its files in c and their metadata
+// in lib. At most maxParallel videos are downloaded and converted at the same
+// time. Subtitles are fetched from timedTextURL if it is set.
+func New(youtubeURL, youtubeToken, timedTextURL string, c *cache.Cache, lib *library.Store, maxParallel int, events *progress.Broker) services.Service {
+	if maxParallel <= 0 {
+		maxParallel = 2
+	}
+	if timedTextURL == "" {
+		timedTextURL = defaultTimedTextURL
+	}
+
+	return &youtubeService{
 		youtubeURL:   youtubeURL,
 		youtubeToken: youtubeToken,
-		videoPath:    videoPath,
+		timedTextURL: timedTextURL,
+		cache:        c,
+		library:      lib,
 		cl:           http.Client{},
 		converter:    multimedia.NewFFMPEG(),
+		downloader:   ytdlDownloader{},
+		events:       events,
+		slots:        make(chan struct{}, maxParallel),
+		playlists:    make(map[string]playlistUploads),
 	}
 }
 
-func (s youtubeService) Search(ctx context.Context, query string) ([]string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/search/?q=%s&part=snippet&type=video&key=%s", s.youtubeURL, query, s.youtubeToken), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
+func (s *youtubeService) Capabilities() services.Capabilities {
+	return services.Capabilities{Search: true, Audio: true, Video: true, Options: true, Playlists: true, Subscriptions: true, Subtitles: true, Transcripts: true, Manage: true}
+}
 
-	req = req.WithContext(ctx)
-	resp, err := s.cl.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query youtube api: %v", err)
+func (s *youtubeService) Search(ctx context.Context, query services.Query) (services.SearchResult, error) {
+	q := url.Values{}
+	q.Set("q", query.Text)
+	q.Set("part", "snippet")
+	q.Set("type", "video")
+	q.Set("maxResults", strconv.Itoa(query.PageSize))
+	if query.PageToken != "" {
+		q.Set("pageToken", query.PageToken)
+	}
+	if query.Duration != "" {
+		q.Set("videoDuration", query.Duration)
+	}
+	if !query.After.IsZero() {
+		q.Set("publishedAfter", query.After.UTC().Format(time.RFC3339))
+	}
+	if !query.Before.IsZero() {
+		q.Set("publishedBefore", query.Before.UTC().Format(time.RFC3339))
+	}
+	if query.Order != "" {
+		q.Set("order", query.Order)
+	}
+	if query.Channel != "" {
+		q.Set("channelId", query.Channel)
 	}
-	defer resp.Body.Close()
 
 	var search search
-	if err := json.NewDecoder(resp.Body).Decode(&search); err != nil {
-		return nil, fmt.Errorf("failed to decode search response: %v", err)
+	if err := s.get(ctx, "search", q, &search); err != nil {
+		return services.SearchResult{}, err
 	}
 
-	var vids []string
-
-	for _, vid := range search.Items {
-		vids = append(vids, vid.ID.VideoID)
+	res := services.SearchResult{
+		Items:         []services.VideoInfo{},
+		NextPageToken: search.NextPageToken,
+		PageSize:      query.PageSize,
+		TotalResults:  search.PageInfo.TotalResults,
 	}
-
-	return vids, nil
+	for _, vid := range search.Items {
+		res.Items = append(res.Items, services.VideoInfo{
+			ID:          vid.ID.VideoID,
+			Title:       vid.Snippet.Title,
+			URL:         "https://youtube.com/watch?v=" + vid.ID.VideoID,
+			Thumbnail:   vid.Snippet.Thumbnails.High.URL,
+			Service:     "youtube",
+			Channel:     vid.Snippet.ChannelTitle,
+			Description: vid.Snippet.Description,
+			Published:   vid.Snippet.PublishedAt,
+		})
+	}
+
+	return res, nil
 }
 
-func (s youtubeService) Info(ctx context.Context, id string) (services.VideoInfo, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/videos/?id=%s&part=snippet&key=%s", s.youtubeURL, id, s.youtubeToken), nil)
-	if err != nil {
-		return services.VideoInfo{}, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req = req.WithContext(ctx)
-	resp, err := s.cl.Do(req)
-	if err != nil {
-		return services.VideoInfo{}, fmt.Errorf("failed to query youtube api: %v", err)
-	}
-	defer resp.Body.Close()
+// Info combines the details of the Data API with the formats offered for
+// download and the languages of subtitles, which are omitted if they can not
+// be retrieved.
+func (s *youtubeService) Info(ctx context.Context, id string) (services.VideoInfo, error) {
+	q := url.Values{}
+	q.Set("id", id)
+	q.Set("part", "snippet,contentDetails")
 
 	var vid video
-	if err := json.NewDecoder(resp.Body).Decode(&vid); err != nil {
-		return services.VideoInfo{}, fmt.Errorf("failed to decode video response: %v", err)
+	if err := s.get(ctx, "videos", q, &vid); err != nil {
+		return services.VideoInfo{}, err
 	}
 
 	if len(vid.Items) == 0 {
 		return services.VideoInfo{}, fmt.Errorf("failed to find video for id: %s", id)
 	}
 
-	return services.VideoInfo{
-		ID:        vid.Items[0].ID,
-		Title:     vid.Items[0].Snippet.Title,
-		URL:       "https://youtube.com/watch?v=" + vid.Items[0].ID,
-		Thumbnail: vid.Items[0].Snippet.Thumbnails.High.URL,
-		Service:   "youtube",
-	}, nil
-}
-
-func (s youtubeService) download(vid *ytdl.VideoInfo, fm ytdl.Format, id, name string) (io.ReadCloser, error) {
-	dir := path.Join(s.videoPath, id)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, errors.New("failed to create video directory")
+	v := vid.Items[0]
+	vi := services.VideoInfo{
+		ID:          v.ID,
+		Title:       v.Snippet.Title,
+		URL:         "https://youtube.com/watch?v=" + v.ID,
+		Thumbnail:   v.Snippet.Thumbnails.High.URL,
+		Service:     "youtube",
+		Channel:     v.Snippet.ChannelTitle,
+		Description: v.Snippet.Description,
+		Tags:        v.Snippet.Tags,
+		Language:    v.Snippet.DefaultAudioLanguage,
+		Duration:    int64(parseDuration(v.ContentDetails.Duration) / time.Second),
+		Published:   v.Snippet.PublishedAt,
 	}
 
-	vidp := path.Join(dir, fmt.Sprintf("%s.%s", name, fm.Extension))
-	if _, err := os.Stat(vidp); err == nil {
-		log.Printf("video already exists: %v", id)
-		vidf, err := os.OpenFile(vidp, os.O_RDONLY, 0755)
+	if v.ContentDetails.Caption == "true" {
+		subs, err := s.Subtitles(ctx, id)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open pre downloaded file: %v", err)
+			log.Printf("failed to retrieve subtitles of %s: %v", id, err)
+		}
+		// automatic subtitles may exist in addition to regular ones
+		seen := make(map[string]bool)
+		for _, sub := range subs {
+			if !seen[sub.Language] {
+				vi.Subtitles = append(vi.Subtitles, sub.Language)
+				seen[sub.Language] = true
+			}
+		}
+	}
+
+	// chapters are listed from the metadata the chapter files are cut by
+	it, ok := s.library.Get("youtube", id)
+	if yi, err := s.downloader.Info(id); err == nil {
+		vi.Formats = formats(yi)
+		if !ok {
+			it, ok = newItem(id, yi), true
 		}
-		return vidf, nil
+	} else {
+		log.Printf("failed to retrieve formats of %s: %v", id, err)
+	}
+	if !ok {
+		it = library.Item{Description: vi.Description, Duration: vi.Duration}
 	}
+	vi.Chapters = services.Chapters(it)
 
-	file, err := os.OpenFile(vidp, os.O_RDWR|os.O_CREATE, 0755)
+	files, err := library.Files(s.cache, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file for download: %v", err)
+		log.Printf("failed to read cached files of %s: %v", id, err)
 	}
+	vi.Artifacts = files
 
-	log.Printf("downloading %s: %v", name, id)
+	return vi, nil
+}
 
-	if err := vid.Download(fm, file); err != nil {
-		file.Close()
-		if err := os.Remove(vidp); err != nil {
-			log.Printf("failed to delete video file: %v", err)
-		}
-		return nil, fmt.Errorf("failed to download video file: %v", err)
+// acquire blocks until one of the parallel download slots is free.
+func (s *youtubeService) acquire(ctx context.Context) (func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	file.Sync()
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek video file: %v", err)
+}
+
+// download stores the stream fm of vid as an artifact named after the kind
+// of stream and its itag.
+func (s *youtubeService) download(ctx context.Context, vid *ytdl.VideoInfo, fm ytdl.Format, id, name string) (string, error) {
+	return s.cache.Artifact(ctx, id, fmt.Sprintf("%s-%d.%s", name, fm.Itag, fm.Extension), cache.Intermediate, func(ctx context.Context, w io.Writer) error {
+		return s.stream(ctx, vid, fm, id, name, w)
+	})
+}
+
+// stream writes the stream fm of vid to w, reporting the progress as
+// downloading the named kind of stream.
+func (s *youtubeService) stream(ctx context.Context, vid *ytdl.VideoInfo, fm ytdl.Format, id, name string, w io.Writer) error {
+	log.Printf("downloading %s: %v", name, id)
+
+	// clen is only known for adaptive formats, otherwise the total stays zero
+	w = progress.NewWriter(w, metaInt(fm, "clen"), s.events.Stage(id, "download "+name, progress.Bytes))
+
+	if err := s.downloader.Download(vid, fm, contextWriter{ctx, w}); err != nil {
+		return fmt.Errorf("failed to download video file: %v", err)
 	}
 
 	log.Printf("finished downloading %s: %v", name, id)
 
-	return file, nil
+	return nil
 }
 
-func (s youtubeService) VideoFile(ctx context.Context, id string) (io.ReadCloser, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
-
-	// fetch video info
-	vid, err := ytdl.GetVideoInfoFromID(id)
+func (s *youtubeService) VideoFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.videoFile(ctx, id, opts)
+	if err == nil {
+		s.record(ctx, id)
+	}
+	s.events.Finish(id, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find video by id: %v", err)
+		return nil, err
 	}
+	return os.Open(p)
+}
 
-	fm := vid.Formats.Copy()
-	fm.Sort(ytdl.FormatResolutionKey, true)
-	if len(fm) == 0 {
-		return nil, errors.New("failed to retrieve video format")
+func (s *youtubeService) videoFile(ctx context.Context, id string, opts services.Options) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
 	}
-
-	vrc, err := s.download(vid, fm[0], id, "video")
-	if err != nil {
-		return nil, err
+	if err := opts.ValidateVideo(); err != nil {
+		return "", err
 	}
-	defer vrc.Close()
 
-	fm = vid.Formats.Copy()
-	fm.Sort(ytdl.FormatAudioBitrateKey, true)
-	if len(fm) == 0 {
-		return nil, errors.New("failed to retrieve video format")
+	name := opts.Selection().Name("combined", "mp4")
+	if !opts.Clip.IsZero() {
+		return services.Clip(ctx, s.cache, s.converter, id, name, cache.Video, "mp4", opts.Clip, s.libraryItem(id), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.videoFile(ctx, id, opts.Unclipped())
+		})
 	}
 
-	arc, err := s.download(vid, fm[0], id, "audio")
+	return s.cache.Artifact(ctx, id, name, cache.Video, func(ctx context.Context, w io.Writer) error {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		// fetch video info
+		vid, err := s.downloader.Info(id)
+		if err != nil {
+			return fmt.Errorf("failed to find video by id: %v", err)
+		}
+
+		vfm, err := selectVideo(vid.Formats, opts)
+		if err != nil {
+			return err
+		}
+
+		afm, err := selectAudio(vid.Formats, "", opts.Codec, opts.AudioBitrate)
+		if err != nil {
+			return err
+		}
+
+		vp, err := s.download(ctx, vid, vfm, id, "video")
+		if err != nil {
+			return err
+		}
+
+		ap, err := s.download(ctx, vid, afm, id, "audio")
+		if err != nil {
+			return err
+		}
+
+		vrc, err := os.Open(vp)
+		if err != nil {
+			return fmt.Errorf("failed to open video file: %v", err)
+		}
+		defer vrc.Close()
+
+		arc, err := os.Open(ap)
+		if err != nil {
+			return fmt.Errorf("failed to open audio file: %v", err)
+		}
+		defer arc.Close()
+
+		subs, err := s.subtitles(ctx, id, opts)
+		if err != nil {
+			return err
+		}
+
+		ctx = multimedia.WithProgress(ctx, s.events.Stage(id, "merge", progress.Milliseconds))
+		err = multimedia.Tagged(ctx, s.converter, w, "mp4", s.tags(ctx, id, vid), func(w io.Writer) error {
+			return s.converter.Merge(ctx, vrc, arc, w, subs...)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to merge video and audio files: %v", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *youtubeService) AudioFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	p, err := s.audioFile(ctx, id, opts)
+	if err == nil {
+		s.record(ctx, id)
+	}
+	s.events.Finish(id, err)
 	if err != nil {
 		return nil, err
 	}
-	defer arc.Close()
+	return os.Open(p)
+}
 
-	vidp := path.Join(s.videoPath, id, "combined.mp4")
-	if _, err := os.Stat(vidp); err == nil {
-		log.Printf("video already exists: %v", id)
-		vidf, err := os.OpenFile(vidp, os.O_RDONLY, 0755)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open pre downloaded file: %v", err)
-		}
-		return vidf, nil
+// audioFile converts the selected audio stream as described by the output
+// spec. If a container is requested, the stream is served as it is instead.
+// It is stored without its itag, so cached streams are found without fetching
+// the video info. Clips are cut from the whole file.
+func (s *youtubeService) audioFile(ctx context.Context, id string, opts services.Options) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
 	}
 
-	file, err := os.OpenFile(vidp, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file for merging: %v", err)
+	if opts.Chapter > 0 {
+		return services.ChapterFile(ctx, s.cache, s.converter, id, opts.AudioExtension(), opts, s.libraryItem(id), s.events.Stage(id, "split", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, opts.Unclipped())
+		})
 	}
 
-	if err := s.converter.Merge(ctx, vrc, arc, file); err != nil {
-		return nil, fmt.Errorf("failed to merge video and audio files: %v", err)
+	if !opts.Clip.IsZero() {
+		ext := opts.AudioExtension()
+		return services.Clip(ctx, s.cache, s.converter, id, opts.Name("audio", ext), cache.Audio, ext, opts.Clip, s.libraryItem(id), s.events.Stage(id, "clip", progress.Milliseconds), func(ctx context.Context) (string, error) {
+			return s.audioFile(ctx, id, opts.Unclipped())
+		})
 	}
-	file.Sync()
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek combined file: %v", err)
+
+	if opts.Container != "" {
+		return s.cache.Artifact(ctx, id, opts.Name("stream", opts.Container), cache.Audio, func(ctx context.Context, w io.Writer) error {
+			release, err := s.acquire(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			vid, fm, err := s.audioFormat(id, opts)
+			if err != nil {
+				return err
+			}
+			return s.stream(ctx, vid, fm, id, "audio", w)
+		})
 	}
 
-	return file, nil
+	return s.cache.Artifact(ctx, id, opts.Name("audio", opts.AudioExtension()), cache.Audio, func(ctx context.Context, w io.Writer) error {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		vid, fm, err := s.audioFormat(id, opts)
+		if err != nil {
+			return err
+		}
+
+		p, err := s.download(ctx, vid, fm, id, "audio")
+		if err != nil {
+			return err
+		}
+
+		rc, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open downloaded file: %v", err)
+		}
+		defer rc.Close()
+
+		log.Printf("converting video: %v", id)
+
+		ctx = multimedia.WithProgress(ctx, s.events.Stage(id, "convert", progress.Milliseconds))
+		err = multimedia.Tagged(ctx, s.converter, w, opts.AudioExtension(), s.tags(ctx, id, vid), func(w io.Writer) error {
+			return s.converter.Convert(ctx, rc, w, opts.Output)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to convert video: %v", err)
+		}
+
+		log.Printf("finished converting video: %v", id)
+
+		return nil
+	})
 }
 
-func (s youtubeService) AudioFile(ctx context.Context, id string) (io.ReadCloser, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
+// audioFormat fetches the video info of id and selects its audio stream.
+func (s *youtubeService) audioFormat(id string, opts services.Options) (*ytdl.VideoInfo, ytdl.Format, error) {
+	vid, err := s.downloader.Info(id)
+	if err != nil {
+		return nil, ytdl.Format{}, fmt.Errorf("failed to find video by id: %v", err)
+	}
 
-	// fetch video info
-	vid, err := ytdl.GetVideoInfoFromID(id)
+	fm, err := selectAudio(vid.Formats, opts.Container, opts.Codec, opts.AudioBitrate)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find video by id: %v", err)
+		return nil, ytdl.Format{}, err
 	}
+	return vid, fm, nil
+}
+
+// contextWriter stops writing once its context is done. It aborts downloads
+// which do not support cancellation themselves.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
 
-	fm := vid.Formats.Copy()
-	fm.Sort(ytdl.FormatAudioEncodingKey, true)
-	if len(fm) == 0 {
-		return nil, errors.New("failed to retrieve video format")
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return w.w.Write(p)
+}
 
-	rc, err := s.download(vid, fm[0], id, "audio")
-	if err != nil {
-		return nil, err
+func (s *youtubeService) List(ctx context.Context) ([]services.VideoInfo, error) {
+	var vids []services.VideoInfo
+	for _, it := range s.library.List("youtube") {
+		vids = append(vids, services.ItemInfo(it))
 	}
+	return vids, nil
+}
 
-	audp := path.Join(s.videoPath, id, "audio.mp3")
-	if _, err := os.Stat(audp); err == nil {
-		log.Printf("audio already exists: %v", id)
-		audf, err := os.OpenFile(audp, os.O_RDONLY, 0755)
+// record stores the metadata of id in the library once one of its files has
+// been written. Metadata is only fetched for videos not known yet and nothing
+// is written if the files of id did not change.
+func (s *youtubeService) record(ctx context.Context, id string) {
+	if s.library.Current(s.cache, "youtube", id) {
+		return
+	}
+
+	it, ok := s.library.Get("youtube", id)
+	if !ok {
+		var err error
+		it, err = s.item(ctx, id)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open pre converted file: %v", err)
+			log.Printf("failed to retrieve library metadata: %v", err)
+			return
 		}
-		return audf, nil
+		it.Downloaded = time.Now()
 	}
 
-	file, err := os.Create(audp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create audio file: %v", err)
+	if _, err := s.library.Add(s.cache, it); err != nil {
+		log.Printf("failed to record library item: %v", err)
 	}
+}
 
-	log.Printf("converting video: %v", id)
-
-	if err := s.converter.Convert(context.Background(), rc, file); err != nil {
-		file.Close()
-		if err := os.Remove(audp); err != nil {
-			log.Printf("failed to delete audio file: %v", err)
-		}
-		return nil, fmt.Errorf("failed to convert video: %v", err)
+// item returns the library metadata of id.
+func (s *youtubeService) item(ctx context.Context, id string) (library.Item, error) {
+	vid, err := s.downloader.Info(id)
+	if err != nil {
+		return library.Item{}, fmt.Errorf("failed to find video by id: %v", err)
 	}
-	file.Sync()
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek audio file: %v", err)
+	return newItem(id, vid), nil
+}
+
+// newItem returns the library metadata of the video vid with the given id.
+func newItem(id string, vid *ytdl.VideoInfo) library.Item {
+	return library.Item{
+		Service:     "youtube",
+		ID:          id,
+		Title:       vid.Title,
+		Channel:     vid.Author,
+		Description: vid.Description,
+		Tags:        vid.Keywords,
+		URL:         "https://youtube.com/watch?v=" + id,
+		Thumbnail:   vid.GetThumbnailURL(ytdl.ThumbnailQualityHigh).String(),
+		Duration:    int64(vid.Duration / time.Second),
+		Published:   vid.DatePublished,
 	}
+}
 
-	log.Printf("finished converting video: %v", id)
+// tags returns the tags written into the files of id. The library metadata is
+// preferred as it may have been edited.
+func (s *youtubeService) tags(ctx context.Context, id string, vid *ytdl.VideoInfo) multimedia.Tags {
+	it, ok := s.library.Get("youtube", id)
+	if !ok {
+		it = newItem(id, vid)
+	}
+	return services.Tags(ctx, it)
+}
 
-	return file, nil
+// libraryItem returns a function looking up the library metadata of id,
+// which is fetched if id is not in the library yet.
+func (s *youtubeService) libraryItem(id string) func(ctx context.Context) (library.Item, error) {
+	return func(ctx context.Context) (library.Item, error) {
+		if it, ok := s.library.Get("youtube", id); ok {
+			return it, nil
+		}
+		return s.item(ctx, id)
+	}
 }
 
-func (s youtubeService) List(ctx context.Context) ([]services.VideoInfo, error) {
-	folders, err := ioutil.ReadDir(s.videoPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve video list: %v", err)
+// Retag rewrites the tags of all converted files of id from its library
+// metadata.
+func (s *youtubeService) Retag(ctx context.Context, id string) error {
+	it, ok := s.library.Get("youtube", id)
+	if !ok {
+		return fmt.Errorf("video %s is not in the library", id)
 	}
 
-	var vids []services.VideoInfo
-	var tims []time.Time
-	for _, f := range folders {
-		vi, err := s.Info(ctx, f.Name())
-		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve video info: %v", err)
-		}
-		vids = append(vids, vi)
-		tims = append(tims, f.ModTime())
+	if err := services.Retag(ctx, s.cache, s.converter, id, services.Tags(ctx, it)); err != nil {
+		return err
 	}
+	_, err := s.library.Modify(s.cache, "youtube", id, func(*library.Item) {})
+	return err
+}
 
-	sort.Slice(vids, func(i, j int) bool { return tims[i].UnixNano() < tims[j].UnixNano() })
+// Update changes the stored metadata of a downloaded video.
+func (s *youtubeService) Update(ctx context.Context, id string, e services.Edit) (library.Item, error) {
+	return services.Update(s.library, s.cache, "youtube", id, e)
+}
 
-	return vids, nil
+// Remove deletes the named files of a video, or all of them along with its
+// library entry.
+func (s *youtubeService) Remove(ctx context.Context, id string, names ...string) error {
+	return services.Remove(s.library, s.cache, "youtube", id, names...)
+}
+
+// Cache returns the cache holding the files of the service.
+func (s *youtubeService) Cache() *cache.Cache {
+	return s.cache
+}
+
+// Reindex rebuilds the library entries of all downloaded videos.
+func (s *youtubeService) Reindex(ctx context.Context) error {
+	items, err := library.Scan("youtube", s.cache, func(id string) (library.Item, error) {
+		return s.item(ctx, id)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan videos: %v", err)
+	}
+	return s.library.Replace("youtube", items)
 }
 
 type search struct {
@@ -376,5 +699,10 @@ type video struct {
 			} `json:"localized"`
 			DefaultAudioLanguage string `json:"defaultAudioLanguage"`
 		} `json:"snippet"`
+		ContentDetails struct {
+			Duration   string `json:"duration"`
+			Definition string `json:"definition"`
+			Caption    string `json:"caption"`
+		} `json:"contentDetails"`
 	} `json:"items"`
 }
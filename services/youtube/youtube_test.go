@@ -0,0 +1,340 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package youtube
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rylio/ytdl"
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/library"
+	"kohlbau.de/x/jaye/multimedia"
+	"kohlbau.de/x/jaye/progress"
+	"kohlbau.de/x/jaye/services"
+)
+
+// fakeDownloader serves two audio streams for every video. Downloads block
+// until release is closed.
+type fakeDownloader struct {
+	started chan int
+	release chan struct{}
+
+	m          sync.Mutex
+	infos      int
+	downloads  map[int]int
+	running    int
+	maxRunning int
+}
+
+func newFakeDownloader() *fakeDownloader {
+	return &fakeDownloader{
+		started:   make(chan int, 10),
+		release:   make(chan struct{}),
+		downloads: make(map[int]int),
+	}
+}
+
+func (d *fakeDownloader) Info(id string) (*ytdl.VideoInfo, error) {
+	d.m.Lock()
+	d.infos++
+	d.m.Unlock()
+
+	return &ytdl.VideoInfo{
+		ID:    id,
+		Title: "Video " + id,
+		Formats: ytdl.FormatList{
+			{Itag: 140, Extension: "mp4", AudioEncoding: "aac", AudioBitrate: 128},
+			{Itag: 251, Extension: "webm", AudioEncoding: "opus", AudioBitrate: 160},
+		},
+	}, nil
+}
+
+func (d *fakeDownloader) Download(vid *ytdl.VideoInfo, fm ytdl.Format, w io.Writer) error {
+	d.m.Lock()
+	d.downloads[fm.Itag]++
+	d.running++
+	if d.running > d.maxRunning {
+		d.maxRunning = d.running
+	}
+	d.m.Unlock()
+
+	d.started <- fm.Itag
+	<-d.release
+
+	d.m.Lock()
+	d.running--
+	d.m.Unlock()
+
+	_, err := io.WriteString(w, vid.ID+"-"+strconv.Itoa(fm.Itag))
+	return err
+}
+
+// total returns the number of downloads of all streams.
+func (d *fakeDownloader) total() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	n := 0
+	for _, c := range d.downloads {
+		n += c
+	}
+	return n
+}
+
+// copyConverter converts files by copying them.
+type copyConverter struct {
+	multimedia.Converter
+}
+
+func (copyConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, spec multimedia.Spec) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func (copyConverter) Tag(ctx context.Context, src io.Reader, dst io.Writer, ext string, tags multimedia.Tags) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func newTestService(t *testing.T, maxParallel int, d downloader) *youtubeService {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "youtube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	lib, err := library.Open(filepath.Join(dir, "library.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", "", "", cache.New(dir), lib, maxParallel, progress.NewBroker()).(*youtubeService)
+	s.downloader = d
+	s.converter = copyConverter{}
+	return s
+}
+
+type result struct {
+	path string
+	err  error
+}
+
+// fetch requests the audio file of id with opts in the background.
+func fetch(s *youtubeService, id string, opts services.Options) <-chan result {
+	c := make(chan result, 1)
+	go func() {
+		p, err := s.audioFile(context.Background(), id, opts)
+		c <- result{p, err}
+	}()
+	return c
+}
+
+// waitStarted returns the itag of the next download which started.
+func waitStarted(t *testing.T, d *fakeDownloader) int {
+	t.Helper()
+	select {
+	case itag := <-d.started:
+		return itag
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not start")
+		return 0
+	}
+}
+
+func TestCoalesceDownloads(t *testing.T) {
+	d := newFakeDownloader()
+	s := newTestService(t, 4, d)
+
+	var results []<-chan result
+	for i := 0; i < 4; i++ {
+		results = append(results, fetch(s, "a", services.Options{}))
+	}
+
+	itag := waitStarted(t, d)
+	// requests arriving later join the running download
+	time.Sleep(50 * time.Millisecond)
+	close(d.release)
+
+	var path string
+	for _, c := range results {
+		r := <-c
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if path == "" {
+			path = r.path
+		}
+		if r.path != path {
+			t.Errorf("got path %s, want %s", r.path, path)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a-" + strconv.Itoa(itag); string(b) != want {
+		t.Errorf("got content %q, want %q", b, want)
+	}
+	if n := d.total(); n != 1 {
+		t.Errorf("got %d downloads, want 1", n)
+	}
+}
+
+func TestParallelArtifacts(t *testing.T) {
+	d := newFakeDownloader()
+	s := newTestService(t, 2, d)
+	vid, _ := d.Info("a")
+
+	var wg sync.WaitGroup
+	for _, fm := range vid.Formats {
+		wg.Add(1)
+		go func(fm ytdl.Format) {
+			defer wg.Done()
+			if _, err := s.download(context.Background(), vid, fm, "a", "audio"); err != nil {
+				t.Error(err)
+			}
+		}(fm)
+	}
+
+	// both streams of the video are downloaded at the same time
+	started := map[int]bool{waitStarted(t, d): true, waitStarted(t, d): true}
+	if !started[140] || !started[251] {
+		t.Errorf("got downloads %v, want 140 and 251", started)
+	}
+	close(d.release)
+	wg.Wait()
+}
+
+func TestParallelLimit(t *testing.T) {
+	d := newFakeDownloader()
+	s := newTestService(t, 1, d)
+
+	a := fetch(s, "a", services.Options{})
+	b := fetch(s, "b", services.Options{})
+
+	waitStarted(t, d)
+	select {
+	case <-d.started:
+		t.Fatal("second download started although only one slot is available")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(d.release)
+
+	for _, c := range []<-chan result{a, b} {
+		if r := <-c; r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.maxRunning != 1 {
+		t.Errorf("got %d parallel downloads, want 1", d.maxRunning)
+	}
+}
+
+func TestRecordChangedFiles(t *testing.T) {
+	d := newFakeDownloader()
+	close(d.release)
+	s := newTestService(t, 1, d)
+
+	get := func() {
+		rc, err := s.AudioFile(context.Background(), "a", services.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+
+	get()
+	if it, ok := s.library.Get("youtube", "a"); !ok || len(it.Files) == 0 {
+		t.Fatalf("got library item %+v, want its files", it)
+	}
+
+	// requests of cached files do not write the metadata again
+	info := s.cache.Path("a", library.InfoName)
+	if err := os.Remove(info); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if _, err := os.Stat(info); !os.IsNotExist(err) {
+		t.Error("library item was recorded although its files did not change")
+	}
+}
+
+func TestCoalesceContainerDownloads(t *testing.T) {
+	d := newFakeDownloader()
+	s := newTestService(t, 4, d)
+	opts := services.Options{Container: "m4a"}
+
+	var results []<-chan result
+	for i := 0; i < 4; i++ {
+		results = append(results, fetch(s, "a", opts))
+	}
+
+	waitStarted(t, d)
+	time.Sleep(50 * time.Millisecond)
+	close(d.release)
+
+	for _, c := range results {
+		r := <-c
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		b, err := ioutil.ReadFile(r.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "a-140" {
+			t.Errorf("got content %q, want %q", b, "a-140")
+		}
+	}
+	if n := d.total(); n != 1 {
+		t.Errorf("got %d downloads, want 1", n)
+	}
+}
+
+func TestCachedContainerSkipsSlot(t *testing.T) {
+	d := newFakeDownloader()
+	close(d.release)
+	s := newTestService(t, 1, d)
+	opts := services.Options{Container: "m4a"}
+
+	if r := <-fetch(s, "a", opts); r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	// cached streams are served while all slots are taken
+	release, err := s.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	select {
+	case r := <-fetch(s, "a", opts):
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cached stream waited for a download slot")
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.infos != 1 {
+		t.Errorf("got %d video info requests, want 1", d.infos)
+	}
+}
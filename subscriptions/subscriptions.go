@@ -0,0 +1,415 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package subscriptions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"kohlbau.de/x/jaye/cache"
+	"kohlbau.de/x/jaye/jobs"
+	"kohlbau.de/x/jaye/services"
+)
+
+const (
+	// window is the number of recent uploads fetched on each check.
+	window = 50
+	// keepSeen is the number of handled uploads remembered per subscription.
+	keepSeen = 500
+)
+
+var (
+	// ErrNotFound is returned for unknown subscriptions.
+	ErrNotFound = errors.New("subscription not found")
+	// ErrExists is returned when subscribing to a channel or playlist of a
+	// service twice.
+	ErrExists = errors.New("subscription exists already")
+)
+
+// Subscription follows the uploads of a channel or playlist.
+type Subscription struct {
+	ID      string    `json:"id"`
+	Service string    `json:"service"`
+	Source  string    `json:"source"` // services.ChannelSource or services.PlaylistSource
+	Target  string    `json:"target"` // id of the channel or playlist
+	Kind    jobs.Kind `json:"kind"`
+	// Options select the variant of the fetched files.
+	Options services.Options `json:"options"`
+	// TitlePattern is a regular expression titles have to match.
+	TitlePattern string `json:"title_pattern,omitempty"`
+	MinDuration  int64  `json:"min_duration,omitempty"` // in seconds
+	MaxDuration  int64  `json:"max_duration,omitempty"` // in seconds
+	// Backfill is the number of existing uploads fetched when subscribing.
+	Backfill    int       `json:"backfill"`
+	Seen        []string  `json:"seen"`
+	Created     time.Time `json:"created"`
+	LastChecked time.Time `json:"last_checked"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// title is the compiled TitlePattern.
+	title *regexp.Regexp
+}
+
+// validate checks that the subscription is complete and its filters are
+// usable. The title pattern is compiled on the way.
+func (s *Subscription) validate() error {
+	if s.Service == "" || s.Target == "" {
+		return errors.New("service and target must be set")
+	}
+	if s.Source != services.ChannelSource && s.Source != services.PlaylistSource {
+		return fmt.Errorf("unknown source: %q", s.Source)
+	}
+	if s.Kind != jobs.Audio && s.Kind != jobs.Video {
+		return fmt.Errorf("unknown kind: %q", s.Kind)
+	}
+	if err := s.Options.Validate(); err != nil {
+		return err
+	}
+	if s.Kind == jobs.Video {
+		if err := s.Options.ValidateVideo(); err != nil {
+			return err
+		}
+	}
+	if err := s.compile(); err != nil {
+		return err
+	}
+	if s.MinDuration < 0 || s.MaxDuration < 0 || (s.MaxDuration > 0 && s.MaxDuration < s.MinDuration) {
+		return errors.New("invalid duration range")
+	}
+	if s.Backfill < 0 || s.Backfill > window {
+		return fmt.Errorf("backfill must be between 0 and %d", window)
+	}
+	return nil
+}
+
+// compile compiles the title pattern.
+func (s *Subscription) compile() error {
+	re, err := regexp.Compile(s.TitlePattern)
+	if err != nil {
+		return fmt.Errorf("invalid title pattern: %v", err)
+	}
+	s.title = re
+	return nil
+}
+
+// sameTarget reports whether s and o follow the same channel or playlist.
+func (s Subscription) sameTarget(o Subscription) bool {
+	return s.Service == o.Service && s.Source == o.Source && s.Target == o.Target
+}
+
+// filtersDuration reports whether the duration of uploads is filtered.
+// Uploads without a duration, such as live streams, can not be filtered yet.
+func (s Subscription) filtersDuration() bool {
+	return s.MinDuration > 0 || s.MaxDuration > 0
+}
+
+// match reports whether the upload passes the filters of the subscription.
+func (s Subscription) match(u services.Upload) bool {
+	if s.title != nil && !s.title.MatchString(u.Title) {
+		return false
+	}
+
+	sec := int64(u.Duration / time.Second)
+	if s.MinDuration > 0 && sec < s.MinDuration {
+		return false
+	}
+	if s.MaxDuration > 0 && sec > s.MaxDuration {
+		return false
+	}
+	return true
+}
+
+// Manager stores subscriptions in a JSON file and periodically submits jobs
+// for their new uploads.
+type Manager struct {
+	m        sync.Mutex
+	check    sync.Mutex
+	path     string
+	subs     map[string]*Subscription
+	registry *services.Registry
+	queue    *jobs.Queue
+	interval time.Duration
+	// ctx is the context of Run, new subscriptions are checked with it
+	ctx context.Context
+}
+
+// Open loads the subscriptions from the file at path. A missing file results
+// in no subscriptions. New uploads are looked up every interval.
+func Open(path string, reg *services.Registry, q *jobs.Queue, interval time.Duration) (*Manager, error) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	m := &Manager{
+		path:     path,
+		subs:     make(map[string]*Subscription),
+		registry: reg,
+		queue:    q,
+		interval: interval,
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriptions: %v", err)
+	}
+
+	var subs []*Subscription
+	if err := json.Unmarshal(b, &subs); err != nil {
+		return nil, fmt.Errorf("failed to decode subscriptions: %v", err)
+	}
+	for _, s := range subs {
+		if err := s.compile(); err != nil {
+			return nil, fmt.Errorf("failed to load subscription %s: %v", s.ID, err)
+		}
+		m.subs[s.ID] = s
+	}
+
+	return m, nil
+}
+
+// List returns all subscriptions ordered by their creation date.
+func (m *Manager) List() []Subscription {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	subs := make([]Subscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		subs = append(subs, *s)
+	}
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+	return subs
+}
+
+// Add stores a new subscription. If the manager is running, its uploads are
+// looked up in the background right away. Following a channel or playlist
+// twice fails with ErrExists.
+func (m *Manager) Add(s Subscription) (Subscription, error) {
+	if err := s.validate(); err != nil {
+		return Subscription{}, err
+	}
+
+	svc, ok := m.registry.Get(s.Service)
+	if !ok {
+		return Subscription{}, fmt.Errorf("unknown service: %q", s.Service)
+	}
+	if _, ok := svc.(services.Subscriber); !ok {
+		return Subscription{}, fmt.Errorf("service %s does not support subscriptions", s.Service)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Subscription{}, fmt.Errorf("failed to generate subscription id: %v", err)
+	}
+
+	s.ID = id
+	s.Seen = nil
+	s.Created = time.Now()
+	s.LastChecked = time.Time{}
+	s.LastError = ""
+
+	m.m.Lock()
+	for _, cur := range m.subs {
+		if cur.sameTarget(s) {
+			m.m.Unlock()
+			return Subscription{}, ErrExists
+		}
+	}
+	m.subs[id] = &s
+	err = m.save()
+	ctx := m.ctx
+	m.m.Unlock()
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	if ctx != nil {
+		go m.Check(ctx)
+	}
+
+	return s, nil
+}
+
+// Remove deletes a subscription. Jobs it submitted are not affected.
+func (m *Manager) Remove(id string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if _, ok := m.subs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.subs, id)
+	return m.save()
+}
+
+// Run checks all subscriptions every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	m.m.Lock()
+	m.ctx = ctx
+	m.m.Unlock()
+
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+
+	m.Check(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.Check(ctx)
+		}
+	}
+}
+
+// Check looks up the uploads of all subscriptions and submits jobs for the
+// ones not seen before.
+func (m *Manager) Check(ctx context.Context) {
+	m.check.Lock()
+	defer m.check.Unlock()
+
+	for _, s := range m.List() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		seen, checked, err := m.fetch(ctx, s)
+		if err != nil {
+			log.Printf("failed to check subscription %s: %v", s.ID, err)
+		}
+
+		m.m.Lock()
+		if cur, ok := m.subs[s.ID]; ok {
+			cur.Seen = merge(seen, cur.Seen)
+			if checked {
+				cur.LastChecked = time.Now()
+			}
+			cur.LastError = ""
+			if err != nil {
+				cur.LastError = err.Error()
+			}
+			if err := m.save(); err != nil {
+				log.Printf("failed to save subscriptions: %v", err)
+			}
+		}
+		m.m.Unlock()
+	}
+}
+
+// fetch submits jobs for the new uploads of s and returns the ids of the
+// uploads which have been handled, including those rejected by the filters.
+// Uploads are only marked as handled once their job has been accepted. It
+// reports whether the uploads could be looked up at all.
+func (m *Manager) fetch(ctx context.Context, s Subscription) ([]string, bool, error) {
+	svc, ok := m.registry.Get(s.Service)
+	if !ok {
+		return nil, false, fmt.Errorf("unknown service: %q", s.Service)
+	}
+	sub, ok := svc.(services.Subscriber)
+	if !ok {
+		return nil, false, fmt.Errorf("service %s does not support subscriptions", s.Service)
+	}
+
+	uploads, err := sub.Uploads(ctx, s.Source, s.Target, window)
+	if err != nil {
+		return nil, false, err
+	}
+
+	known := make(map[string]bool)
+	for _, id := range s.Seen {
+		known[id] = true
+	}
+	first := s.LastChecked.IsZero()
+
+	// uploads existing before the subscription are only fetched up to the
+	// backfill limit, starting with the newest
+	uploads = append([]services.Upload(nil), uploads...)
+	sort.SliceStable(uploads, func(i, j int) bool { return uploads[i].Published.After(uploads[j].Published) })
+
+	var seen []string
+	var failed error
+	for i, u := range uploads {
+		if known[u.ID] {
+			continue
+		}
+
+		if first && i >= s.Backfill {
+			seen = append(seen, u.ID)
+			continue
+		}
+		if u.Duration == 0 && s.filtersDuration() {
+			// checked again once the duration is known
+			continue
+		}
+		if !s.match(u) {
+			seen = append(seen, u.ID)
+			continue
+		}
+
+		j, err := m.queue.Submit(svc, s.Service, u.ID, s.Kind, s.Options)
+		if err != nil {
+			// retried on the next check
+			if failed == nil {
+				failed = fmt.Errorf("failed to submit job for %s: %v", u.ID, err)
+			}
+			continue
+		}
+		log.Printf("subscription %s submitted job %s for %s", s.ID, j.ID, u.ID)
+		seen = append(seen, u.ID)
+	}
+
+	return seen, true, failed
+}
+
+// save writes all subscriptions to disk. The caller must hold the lock.
+func (m *Manager) save() error {
+	subs := make([]*Subscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+
+	b, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode subscriptions: %v", err)
+	}
+
+	if err := cache.WriteFile(m.path, b); err != nil {
+		return fmt.Errorf("failed to write subscriptions: %v", err)
+	}
+	return nil
+}
+
+// merge prepends ids to seen, keeping at most keepSeen entries.
+func merge(ids, seen []string) []string {
+	all := append(append([]string{}, ids...), seen...)
+	if len(all) > keepSeen {
+		all = all[:keepSeen]
+	}
+	return all
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package subscriptions
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kohlbau.de/x/jaye/jobs"
+	"kohlbau.de/x/jaye/services"
+)
+
+// fakeService lists its uploads in playlist order and records the videos
+// fetched by jobs.
+type fakeService struct {
+	m       sync.Mutex
+	uploads []services.Upload
+	fetched []string
+}
+
+func (s *fakeService) add(id string, day int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.uploads = append(s.uploads, services.Upload{
+		ID:        id,
+		Title:     "Video " + id,
+		Published: time.Date(2017, 1, day, 0, 0, 0, 0, time.UTC),
+	})
+}
+
+func (s *fakeService) Capabilities() services.Capabilities {
+	return services.Capabilities{Audio: true, Subscriptions: true}
+}
+
+func (s *fakeService) Search(ctx context.Context, q services.Query) (services.SearchResult, error) {
+	return services.SearchResult{}, services.ErrNotSupported
+}
+
+func (s *fakeService) Info(ctx context.Context, id string) (services.VideoInfo, error) {
+	return services.VideoInfo{ID: id}, nil
+}
+
+func (s *fakeService) AudioFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	s.m.Lock()
+	s.fetched = append(s.fetched, id)
+	s.m.Unlock()
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (s *fakeService) VideoFile(ctx context.Context, id string, opts services.Options) (io.ReadCloser, error) {
+	return nil, services.ErrNotSupported
+}
+
+func (s *fakeService) List(ctx context.Context) ([]services.VideoInfo, error) {
+	return nil, nil
+}
+
+func (s *fakeService) Uploads(ctx context.Context, source, id string, max int) ([]services.Upload, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]services.Upload(nil), s.uploads...), nil
+}
+
+// waitFetched waits until the jobs fetched n videos and returns them sorted.
+func (s *fakeService) waitFetched(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.m.Lock()
+		fetched := append([]string(nil), s.fetched...)
+		s.m.Unlock()
+
+		if len(fetched) >= n || time.Now().After(deadline) {
+			// jobs submitted by mistake would have run by now
+			time.Sleep(50 * time.Millisecond)
+			s.m.Lock()
+			fetched = append([]string(nil), s.fetched...)
+			s.m.Unlock()
+
+			sort.Strings(fetched)
+			return fetched
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newManager(t *testing.T, svc *fakeService) *Manager {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	reg := services.NewRegistry()
+	reg.Add("fake", svc)
+
+	q := jobs.New(1, 10)
+	t.Cleanup(q.Close)
+
+	m, err := Open(filepath.Join(dir, "subscriptions.json"), reg, q, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBackfillNewest(t *testing.T) {
+	svc := &fakeService{}
+	svc.add("a", 1)
+	svc.add("b", 3)
+	svc.add("c", 2)
+	svc.add("d", 4)
+	m := newManager(t, svc)
+
+	sub, err := m.Add(Subscription{
+		Service:  "fake",
+		Source:   services.PlaylistSource,
+		Target:   "PL1",
+		Kind:     jobs.Audio,
+		Backfill: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Check(context.Background())
+	if got, want := strings.Join(svc.waitFetched(t, 2), ","), "b,d"; got != want {
+		t.Errorf("got backfill %s, want %s", got, want)
+	}
+
+	// videos added later are fetched regardless of their position
+	svc.add("e", 5)
+	m.Check(context.Background())
+	if got, want := strings.Join(svc.waitFetched(t, 3), ","), "b,d,e"; got != want {
+		t.Errorf("got fetched %s, want %s", got, want)
+	}
+
+	subs := m.List()
+	if len(subs) != 1 || subs[0].ID != sub.ID || len(subs[0].Seen) != 5 {
+		t.Errorf("got subscriptions %+v, want all uploads of %s seen", subs, sub.ID)
+	}
+}
+
+func TestAddChecksWhileRunning(t *testing.T) {
+	svc := &fakeService{}
+	svc.add("a", 1)
+	m := newManager(t, svc)
+
+	s := Subscription{
+		Service:  "fake",
+		Source:   services.ChannelSource,
+		Target:   "UC1",
+		Kind:     jobs.Audio,
+		Backfill: 1,
+	}
+
+	// subscriptions added before the manager runs are checked by Run
+	if _, err := m.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	if fetched := svc.waitFetched(t, 0); len(fetched) != 0 {
+		t.Errorf("got fetched %v before the manager runs", fetched)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if got := strings.Join(svc.waitFetched(t, 1), ","); got != "a" {
+		t.Errorf("got fetched %s, want a", got)
+	}
+
+	// channels are only followed once
+	if _, err := m.Add(s); err != ErrExists {
+		t.Errorf("got error %v for duplicate subscription, want %v", err, ErrExists)
+	}
+
+	// the check started by Add fetches b for both subscriptions
+	svc.add("b", 2)
+	s.Target = "UC2"
+	if _, err := m.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(svc.waitFetched(t, 3), ","); got != "a,b,b" {
+		t.Errorf("got fetched %s, want a,b,b", got)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	svc := &fakeService{}
+	m := newManager(t, svc)
+
+	sub, err := m.Add(Subscription{
+		Service:      "fake",
+		Source:       services.ChannelSource,
+		Target:       "UC1",
+		Kind:         jobs.Audio,
+		TitlePattern: "^Video [ab]$",
+		MinDuration:  60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Check(context.Background())
+
+	svc.add("a", 1)
+	svc.add("b", 2)
+	svc.add("c", 3)
+	svc.m.Lock()
+	svc.uploads[0].Duration = 2 * time.Minute
+	svc.uploads[2].Duration = 2 * time.Minute
+	svc.m.Unlock()
+
+	// b is live without a duration yet, c does not match the title pattern
+	m.Check(context.Background())
+	if got := strings.Join(svc.waitFetched(t, 1), ","); got != "a" {
+		t.Errorf("got fetched %s, want a", got)
+	}
+	if seen := strings.Join(m.List()[0].Seen, ","); seen != "c,a" {
+		t.Errorf("got seen %s, want c,a", seen)
+	}
+
+	// once its duration is known, b is checked again
+	svc.m.Lock()
+	svc.uploads[1].Duration = 2 * time.Minute
+	svc.m.Unlock()
+	m.Check(context.Background())
+	if got := strings.Join(svc.waitFetched(t, 2), ","); got != "a,b" {
+		t.Errorf("got fetched %s, want a,b", got)
+	}
+	if subs := m.List(); len(subs) != 1 || subs[0].ID != sub.ID {
+		t.Errorf("got subscriptions %+v, want %s", subs, sub.ID)
+	}
+}
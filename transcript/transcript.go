@@ -0,0 +1,203 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+// Package transcript turns subtitles into readable transcripts.
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+// Segment is a line of a transcript.
+type Segment struct {
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
+	Text  string        `json:"text"`
+}
+
+// Paragraph groups the segments of a chapter.
+type Paragraph struct {
+	Title    string        `json:"title,omitempty"`
+	Start    time.Duration `json:"start"`
+	Segments []Segment     `json:"segments"`
+}
+
+// Transcript is the cleaned text of the subtitles of a video.
+type Transcript struct {
+	Language   string      `json:"language"`
+	Paragraphs []Paragraph `json:"paragraphs"`
+}
+
+var (
+	cueTiming = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3}) --> ((?:\d+:)?\d{2}:\d{2}\.\d{3})`)
+	cueTag    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// Parse reads the segments of a WebVTT subtitle. Automatically generated
+// subtitles repeat the previous line in each cue, such duplicates are
+// removed.
+func Parse(vtt []byte) []Segment {
+	var segs []Segment
+	var start, end time.Duration
+	inCue := false
+
+	sc := bufio.NewScanner(bytes.NewReader(vtt))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if m := cueTiming.FindStringSubmatch(line); m != nil {
+			start, _ = timestamp(m[1])
+			end, _ = timestamp(m[2])
+			inCue = true
+			continue
+		}
+		if line == "" {
+			inCue = false
+			continue
+		}
+		if !inCue {
+			continue
+		}
+
+		text := strings.Join(strings.Fields(cueTag.ReplaceAllString(line, "")), " ")
+		if text == "" {
+			continue
+		}
+		if n := len(segs); n > 0 && segs[n-1].Text == text {
+			continue
+		}
+		segs = append(segs, Segment{Start: start, End: end, Text: text})
+	}
+	return segs
+}
+
+// timestamp parses WebVTT timestamps like 01:02:03.456 or 02:03.456.
+func timestamp(s string) (time.Duration, bool) {
+	parts := strings.Split(s, ":")
+	var d time.Duration
+	for i, p := range parts {
+		if i == len(parts)-1 {
+			sec, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return 0, false
+			}
+			return d*60 + time.Duration(math.Round(sec*1000))*time.Millisecond, true
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, false
+		}
+		d = d*60 + time.Duration(n)*time.Second
+	}
+	return d, true
+}
+
+// New returns the transcript of the segments in the given language, split
+// into paragraphs at the chapter boundaries.
+func New(lang string, segs []Segment, chapters []multimedia.Chapter) Transcript {
+	t := Transcript{Language: lang, Paragraphs: []Paragraph{}}
+	if len(chapters) == 0 {
+		if len(segs) > 0 {
+			t.Paragraphs = append(t.Paragraphs, Paragraph{Segments: segs})
+		}
+		return t
+	}
+
+	for i, ch := range chapters {
+		p := Paragraph{Title: ch.Title, Start: ch.Start}
+		for _, s := range segs {
+			// segments before the first chapter belong to it
+			if (s.Start >= ch.Start || i == 0) && (i+1 == len(chapters) || s.Start < chapters[i+1].Start) {
+				p.Segments = append(p.Segments, s)
+			}
+		}
+		t.Paragraphs = append(t.Paragraphs, p)
+	}
+	return t
+}
+
+// Text returns the plain text of the transcript without timestamps.
+func (t Transcript) Text() string {
+	var b bytes.Buffer
+	t.WriteText(&b, false)
+	return b.String()
+}
+
+// WriteText writes the transcript as plain text. Paragraphs are separated by
+// blank lines and start with the title of their chapter. With timestamps,
+// every segment is written on its own line prefixed by its start.
+func (t Transcript) WriteText(w io.Writer, timestamps bool) error {
+	bw := bufio.NewWriter(w)
+	for i, p := range t.Paragraphs {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		if p.Title != "" {
+			fmt.Fprintln(bw, p.Title)
+			fmt.Fprintln(bw)
+		}
+		writeSegments(bw, p.Segments, timestamps, "[%s] ", "\n")
+	}
+	return bw.Flush()
+}
+
+// WriteMarkdown writes the transcript as Markdown document with the given
+// title. Chapters become sections.
+func (t Transcript) WriteMarkdown(w io.Writer, title string, timestamps bool) error {
+	bw := bufio.NewWriter(w)
+	if title != "" {
+		fmt.Fprintf(bw, "# %s\n\n", title)
+	}
+	for i, p := range t.Paragraphs {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		if p.Title != "" {
+			fmt.Fprintf(bw, "## %s\n\n", p.Title)
+		}
+		// two trailing spaces break lines in Markdown
+		writeSegments(bw, p.Segments, timestamps, "**[%s]** ", "  \n")
+	}
+	return bw.Flush()
+}
+
+// writeSegments writes the text of segs as one line. With timestamps, each
+// segment is written on its own line, prefixed with its start formatted by
+// prefix and terminated by sep.
+func writeSegments(w io.Writer, segs []Segment, timestamps bool, prefix, sep string) {
+	if len(segs) == 0 {
+		return
+	}
+	if !timestamps {
+		texts := make([]string, len(segs))
+		for i, s := range segs {
+			texts[i] = s.Text
+		}
+		fmt.Fprintln(w, strings.Join(texts, " "))
+		return
+	}
+	for i, s := range segs {
+		fmt.Fprintf(w, prefix+"%s", clock(s.Start), s.Text)
+		if i+1 < len(segs) {
+			io.WriteString(w, sep)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// clock formats d as HH:MM:SS.
+func clock(d time.Duration) string {
+	sec := int64(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+}
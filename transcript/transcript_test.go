@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Tobias Kohlbau
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package transcript
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"kohlbau.de/x/jaye/multimedia"
+)
+
+const sec = time.Second
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		vtt  string
+		segs []Segment
+	}{
+		{
+			name: "regular cues",
+			vtt: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello <b>world</b>\n\n" +
+				"00:03.000 --> 00:04.000 align:start\r\nsecond\r\nline\r\n",
+			segs: []Segment{
+				{Start: sec, End: 2500 * time.Millisecond, Text: "Hello world"},
+				{Start: 3 * sec, End: 4 * sec, Text: "second"},
+				{Start: 3 * sec, End: 4 * sec, Text: "line"},
+			},
+		},
+		{
+			name: "repeated lines",
+			vtt: "WEBVTT\n\n00:00.000 --> 00:02.000\nhello there\n\n" +
+				"00:02.000 --> 00:04.000\nhello there\ngeneral <00:00:03.000><c>kenobi</c>\n",
+			segs: []Segment{
+				{Start: 0, End: 2 * sec, Text: "hello there"},
+				{Start: 2 * sec, End: 4 * sec, Text: "general kenobi"},
+			},
+		},
+		{
+			name: "text outside of cues",
+			vtt:  "WEBVTT\nKind: captions\n\nNOTE comment\n\n00:00.000 --> 00:01.000\n  \n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := Parse([]byte(tt.vtt)); !reflect.DeepEqual(got, tt.segs) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.segs)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		s  string
+		d  time.Duration
+		ok bool
+	}{
+		{s: "00:00.000", d: 0, ok: true},
+		{s: "02:03.456", d: 2*time.Minute + 3456*time.Millisecond, ok: true},
+		{s: "01:02:03.004", d: time.Hour + 2*time.Minute + 3004*time.Millisecond, ok: true},
+		{s: "a:03.000", ok: false},
+		{s: "02:x", ok: false},
+	}
+
+	for _, tt := range tests {
+		d, ok := timestamp(tt.s)
+		if d != tt.d || ok != tt.ok {
+			t.Errorf("timestamp(%q) = %v, %v, want %v, %v", tt.s, d, ok, tt.d, tt.ok)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	segs := []Segment{
+		{Start: 0, Text: "before"},
+		{Start: 5 * sec, Text: "intro"},
+		{Start: 60 * sec, Text: "main"},
+		{Start: 90 * sec, Text: "more"},
+	}
+	tests := []struct {
+		name       string
+		segs       []Segment
+		chapters   []multimedia.Chapter
+		paragraphs []Paragraph
+	}{
+		{
+			name:       "without chapters",
+			segs:       segs,
+			paragraphs: []Paragraph{{Segments: segs}},
+		},
+		{
+			name:       "without segments",
+			paragraphs: []Paragraph{},
+		},
+		{
+			name: "split at chapters",
+			segs: segs,
+			chapters: []multimedia.Chapter{
+				{Title: "Intro", Start: 2 * sec},
+				{Title: "Main", Start: 60 * sec},
+				{Title: "Outro", Start: 120 * sec},
+			},
+			paragraphs: []Paragraph{
+				{Title: "Intro", Start: 2 * sec, Segments: segs[:2]},
+				{Title: "Main", Start: 60 * sec, Segments: segs[2:]},
+				{Title: "Outro", Start: 120 * sec},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := New("en", tt.segs, tt.chapters)
+		if got.Language != "en" || !reflect.DeepEqual(got.Paragraphs, tt.paragraphs) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got.Paragraphs, tt.paragraphs)
+		}
+	}
+}